@@ -0,0 +1,100 @@
+package main
+
+// calibration of measured values
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+/* calibration can be given in config as
+ * - number: offset added to the value
+ * - {"gain": 1.02, "offset": -0.5}: linear calibration value*gain+offset
+ * - {"points": [[raw1, ref1], [raw2, ref2], ...]}: measured values and the reference values
+ *   they should be, two points for a two-point calibration, more for a piecewise-linear table
+ */
+type Calibration struct {
+	Gain   float64
+	Offset float64
+	Points [][2]float64 // sorted by raw value
+}
+
+type calibrationJSON struct {
+	Gain   *float64     `json:"gain"`
+	Offset float64      `json:"offset"`
+	Points [][2]float64 `json:"points"`
+}
+
+func (c *Calibration) UnmarshalJSON(data []byte) error {
+	// simple offset
+	var offset float64
+	if json.Unmarshal(data, &offset) == nil {
+		c.Gain = 1
+		c.Offset = offset
+		c.Points = nil
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var cj calibrationJSON
+	err := dec.Decode(&cj)
+	if err != nil {
+		return err
+	}
+
+	if len(cj.Points) > 0 {
+		if cj.Gain != nil || cj.Offset != 0 {
+			return fmt.Errorf("calibration with points can't have gain or offset")
+		}
+		if len(cj.Points) < 2 {
+			return fmt.Errorf("calibration needs at least two points")
+		}
+
+		sort.Slice(cj.Points, func(i, j int) bool { return cj.Points[i][0] < cj.Points[j][0] })
+		for i := 1; i < len(cj.Points); i++ {
+			if cj.Points[i][0] == cj.Points[i-1][0] {
+				return fmt.Errorf("calibration has multiple points for value %v", cj.Points[i][0])
+			}
+		}
+
+		c.Points = cj.Points
+		return nil
+	}
+
+	c.Gain = 1
+	if cj.Gain != nil {
+		c.Gain = *cj.Gain
+	}
+	c.Offset = cj.Offset
+	c.Points = nil
+
+	return nil
+}
+
+func (c *Calibration) Apply(v float64) float64 {
+	if len(c.Points) == 0 {
+		return v*c.Gain + c.Offset
+	}
+
+	// find segment for value, values outside of the table are extrapolated using the first/last segment
+	i := 1
+	for i < len(c.Points)-1 && v > c.Points[i][0] {
+		i++
+	}
+
+	p1, p2 := c.Points[i-1], c.Points[i]
+
+	return p1[1] + (v-p1[0])*(p2[1]-p1[1])/(p2[0]-p1[0])
+}
+
+func (c *Calibration) String() string {
+	if len(c.Points) > 0 {
+		return fmt.Sprintf("points %v", c.Points)
+	}
+
+	return fmt.Sprintf("gain %f offset %f", c.Gain, c.Offset)
+}
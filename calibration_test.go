@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCalibration(t *testing.T) {
+	tests := []struct {
+		json    string
+		values  [][2]float64 // raw and calibrated value
+		invalid bool
+	}{
+		{`-1.5`, [][2]float64{{20, 18.5}, {-3, -4.5}}, false},
+		{`{"offset": 2}`, [][2]float64{{20, 22}}, false},
+		{`{"gain": 1.1}`, [][2]float64{{20, 22}, {0, 0}}, false},
+		{`{"gain": 0}`, [][2]float64{{20, 0}}, false},
+		{`{"gain": 2, "offset": -1}`, [][2]float64{{3, 5}}, false},
+		// points are sorted, values outside are extrapolated with the first/last segment
+		{`{"points": [[100, 90], [0, 0], [50, 40]]}`, [][2]float64{{0, 0}, {25, 20}, {50, 40}, {75, 65}, {100, 90}, {-10, -8}, {110, 100}}, false},
+		{`{"points": [[0, 1], [10, 11]]}`, [][2]float64{{5, 6}, {20, 21}}, false},
+		{`{"points": [[0, 1]]}`, nil, true},
+		{`{"points": [[0, 1], [0, 2]]}`, nil, true},
+		{`{"points": [[0, 1], [10, 11]], "offset": 1}`, nil, true},
+		{`{"points": [[0, 1], [10, 11]], "gain": 1}`, nil, true},
+		{`{"gain": 1, "factor": 2}`, nil, true},
+		{`"1"`, nil, true},
+	}
+
+	for _, test := range tests {
+		var c Calibration
+		err := json.Unmarshal([]byte(test.json), &c)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", test.json, c.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.json, err)
+			continue
+		}
+
+		for _, v := range test.values {
+			cal := c.Apply(v[0])
+			if cal < v[1]-1e-9 || cal > v[1]+1e-9 {
+				t.Errorf("%s: Apply(%v) = %v, expected %v", test.json, v[0], cal, v[1])
+			}
+		}
+	}
+}
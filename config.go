@@ -3,47 +3,379 @@ package main
 // config structs and JSON support
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sberk42/sensor_exporter/sensors"
 	log "github.com/sirupsen/logrus"
 )
 
 // Config to add constant labels to
 type SensorConfig struct {
-	DeviceType   string             `json:"deviceType"`
-	DeviceId     string             `json:"deviceId"`
-	DeviceVendor string             `json:"deviceVendor"`
-	DeviceName   string             `json:"deviceName"`
-	SensorModel  string             `json:"sensorModel"`
-	SensorId     string             `json:"sensorId"`
-	Labels       map[string]string  `json:"labels"`
-	Calibrations map[string]float64 `json:"calibrations"`
-	Ignore       bool               `json:"ignore"`
-	IgnoreCount  int
+	DeviceType   string                  `json:"deviceType"`
+	DeviceId     string                  `json:"deviceId"`
+	DeviceVendor string                  `json:"deviceVendor"`
+	DeviceName   string                  `json:"deviceName"`
+	SensorModel  string                  `json:"sensorModel"`
+	SensorId     string                  `json:"sensorId"`
+	Labels       map[string]string       `json:"labels"`
+	Calibrations map[string]*Calibration `json:"calibrations"`
+	Ignore       *bool                   `json:"ignore"`
+	Priority     int                     `json:"priority"`
+	FollowNewId  bool                    `json:"followNewId"` // bind to model and channel, following id changes
+	IgnoreCount  int                     `json:"-"`
 	idFields     []string
+	matcher      *regexp.Regexp       // set if id fields use patterns, all fields joined for numbering capture groups
+	fieldMatcher []*regexp.Regexp     // anchored regex per id field, nil for fields matching any value
+	ignoredSeen  map[string]time.Time // last ignored value per sensor
+	followedId   string               // sensor id currently followed, guarded by followLock
+	candidates   map[string]bool      // replacement candidates already logged, guarded by followLock
 }
 
 type ExporterConfig struct {
-	DeviceConfigs map[string]*sensors.DeviceConfig `json:"device_configs"`
-	SensorConfigs []*SensorConfig                  `json:"sensor_configs"`
+	DeviceConfigs         DeviceConfigs   `json:"device_configs"`
+	SensorConfigs         []*SensorConfig `json:"sensor_configs"`
+	MergeSensorConfigs    bool            `json:"merge_sensor_configs"`
+	OnlyConfiguredSensors bool            `json:"only_configured_sensors"` // drop measurements from sensors not matching a sensor config
+	mergeOrder            []*SensorConfig // sensor configs sorted from general to specific
+}
+
+func (sc *SensorConfig) ignored() bool {
+	return sc.Ignore != nil && *sc.Ignore
+}
+
+// number of id fields set, configs with more fields set are more specific
+func (sc *SensorConfig) specificity() int {
+	count := 0
+	for _, f := range sc.idFields {
+		if f != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// sort configs for merging, later ones override settings of the earlier ones,
+// for configs with same priority and specificity the first one in the file wins
+func (config *ExporterConfig) sortMergeOrder() {
+	config.mergeOrder = make([]*SensorConfig, len(config.SensorConfigs))
+	for i, sc := range config.SensorConfigs {
+		config.mergeOrder[len(config.SensorConfigs)-1-i] = sc
+	}
+
+	sort.SliceStable(config.mergeOrder, func(i, j int) bool {
+		sci, scj := config.mergeOrder[i], config.mergeOrder[j]
+		if sci.Priority != scj.Priority {
+			return sci.Priority < scj.Priority
+		}
+
+		return sci.specificity() < scj.specificity()
+	})
 }
 
 func ParseConfigJSON(cfgFile string) (*ExporterConfig, error) {
 
 	// read metrics
-	jsonData, err := ioutil.ReadFile(*flagConfigFile)
+	jsonData, err := ioutil.ReadFile(cfgFile)
 	if err != nil {
 		return nil, err
 	}
 
+	// be strict and reject unknown keys, most likely they are typos
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+
 	var config *ExporterConfig
-	err = json.Unmarshal(jsonData, &config)
+	err = dec.Decode(&config)
 	if err != nil {
 		return nil, err
 	}
 	log.Debugf("CONFIG: read config: %v", config)
 
+	var errs []string
+	for i, sc := range config.SensorConfigs {
+		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
+
+		err = sc.compileMatcher()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("sensor_configs[%d]: %s", i, err))
+		}
+	}
+
+	config.sortMergeOrder()
+
+	checkErrs, warnings := checkConfig(config)
+	errs = append(errs, checkErrs...)
+	for _, w := range warnings {
+		log.Warnf("CONFIG: %s", w)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+
 	return config, nil
 }
+
+// id fields starting with this prefix are regular expressions
+const regexPrefix = "re:"
+
+// id fields are joined with a separator not used in labels for expanding capture groups
+const idSeparator = "\x00"
+
+// build an anchored regex per id field, so ^ and $ refer to the field, and one regex of all
+// id fields, so capture groups are numbered in the order of the fields and can be referenced
+// in label values as $1 or ${name}
+func (sc *SensorConfig) compileMatcher() error {
+	usesPattern := false
+	patterns := make([]string, len(sc.idFields))
+
+	for i, f := range sc.idFields {
+		if f == "" {
+			patterns[i] = "[^" + idSeparator + "]*"
+		} else if strings.HasPrefix(f, regexPrefix) {
+			re := strings.TrimPrefix(f, regexPrefix)
+			_, err := regexp.Compile(re)
+			if err != nil {
+				return fmt.Errorf("invalid regex '%s': %s", re, err)
+			}
+
+			patterns[i] = "(?:" + re + ")"
+			usesPattern = true
+		} else if strings.ContainsAny(f, "*?") {
+			// glob: only * and ? are supported
+			glob := regexp.QuoteMeta(f)
+			glob = strings.ReplaceAll(glob, `\*`, "(.*)")
+			glob = strings.ReplaceAll(glob, `\?`, "(.)")
+
+			patterns[i] = glob
+			usesPattern = true
+		} else {
+			patterns[i] = regexp.QuoteMeta(f)
+		}
+	}
+
+	if !usesPattern {
+		sc.matcher = nil
+		sc.fieldMatcher = nil
+		return nil
+	}
+
+	var err error
+	sc.matcher, err = regexp.Compile("^" + strings.Join(patterns, idSeparator) + "$")
+	if err != nil {
+		return err
+	}
+
+	sc.fieldMatcher = make([]*regexp.Regexp, len(patterns))
+	for i, f := range sc.idFields {
+		if f != "" {
+			sc.fieldMatcher[i], err = regexp.Compile("^(?:" + patterns[i] + ")$")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// match id fields each against its regex, the indexes of the capture groups are
+// returned as if the joined fields were matched by the regex of all fields
+func (sc *SensorConfig) matchFields(fields []string) (string, []int) {
+	src := strings.Join(fields, idSeparator)
+	m := []int{0, len(src)}
+
+	start := 0
+	for i, f := range fields {
+		if sc.fieldMatcher[i] != nil {
+			fm := sc.fieldMatcher[i].FindStringSubmatchIndex(f)
+			if fm == nil {
+				return "", nil
+			}
+
+			for _, idx := range fm[2:] {
+				if idx >= 0 {
+					idx += start
+				}
+				m = append(m, idx)
+			}
+		}
+
+		start += len(f) + len(idSeparator)
+	}
+
+	return src, m
+}
+
+// check config for things json parsing can't detect, errors make the config invalid
+func checkConfig(config *ExporterConfig) (errs []string, warnings []string) {
+
+	names := make(map[string]bool)
+	deviceIds := make(map[string]string) // instance by driver and device_id
+	var configMetrics []string           // metrics defined in device configs
+	for _, inst := range config.DeviceConfigs {
+		id, devCfg := inst.Name, inst.deviceConfig()
+
+		if names[id] {
+			errs = append(errs, fmt.Sprintf("device_configs: duplicate device '%s'", id))
+		}
+		names[id] = true
+
+		sensorDev, ok := sensors.SupportedSensorDevices[inst.Driver]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("device_configs: unknown driver '%s' for device '%s'", inst.Driver, id))
+			continue
+		}
+
+		var deviceId string
+		err := devCfg.Get("device_id", &deviceId)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("device_configs: %s: %s", id, err))
+		}
+
+		// same labels for both instances would make the scrapes fail
+		other, ok := deviceIds[inst.Driver+"/"+deviceId]
+		if ok {
+			errs = append(errs, fmt.Sprintf("device_configs: devices '%s' and '%s' have the same device_id '%s'", other, id, deviceId))
+		}
+		deviceIds[inst.Driver+"/"+deviceId] = id
+
+		for key := range *devCfg {
+			if indexOf(sensorDev.ConfigKeys, key) == -1 && indexOf(sensors.CommonConfigKeys, key) == -1 {
+				errs = append(errs, fmt.Sprintf("device_configs: unknown key '%s' for device '%s'", key, id))
+			}
+		}
+
+		if sensorDev.InitConfigFunction != nil {
+			names, err := sensorDev.InitConfigFunction(devCfg)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("device_configs: %s: %s", id, err))
+			}
+			configMetrics = append(configMetrics, names...)
+		}
+	}
+
+	metricNames := configMetrics
+	for _, mt := range sensors.GetAllMeasurementTypes() {
+		// statistics of the sensors are not calibrated
+		if !sensors.IsSensorStats(mt) {
+			metricNames = append(metricNames, sensors.GetMeasurementTypeDetails(mt).MetricName)
+		}
+	}
+
+	for i, sc := range config.SensorConfigs {
+		for cal, c := range sc.Calibrations {
+			if c == nil {
+				errs = append(errs, fmt.Sprintf("sensor_configs[%d]: no calibration set for '%s'", i, cal))
+			}
+			if !knownMetric(metricNames, cal) {
+				errs = append(errs, fmt.Sprintf("sensor_configs[%d]: unknown measurement '%s' in calibrations", i, cal))
+			}
+		}
+
+		if sc.FollowNewId && (!sc.identifiesSensor() || sensorChannel(sc.SensorId) == "") {
+			// without channel any new sensor of the model would be followed
+			errs = append(errs, fmt.Sprintf("sensor_configs[%d]: followNewId requires sensorModel and sensorId with channel (<channel>_<id>) without patterns", i))
+		}
+
+		for lbl := range sc.Labels {
+			if indexOf(builtinLabels, lbl) != -1 {
+				warnings = append(warnings, fmt.Sprintf("sensor_configs[%d]: label '%s' overrides built-in label", i, lbl))
+			}
+		}
+
+		if config.MergeSensorConfigs {
+			continue
+		}
+
+		for j, prev := range config.SensorConfigs[:i] {
+			if shadowsConfig(prev, sc) {
+				warnings = append(warnings, fmt.Sprintf("sensor_configs[%d]: can never match, all sensors are matched by sensor_configs[%d] before", i, j))
+				break
+			}
+		}
+	}
+
+	return errs, warnings
+}
+
+// metric names ending with * match all metrics with this prefix
+func knownMetric(metricNames []string, name string) bool {
+	for _, n := range metricNames {
+		if n == name || (strings.HasSuffix(n, "*") && strings.HasPrefix(name, strings.TrimSuffix(n, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// first match wins, so a config matching everything the later one matches hides it
+func shadowsConfig(prev *SensorConfig, sc *SensorConfig) bool {
+	for i, f := range prev.idFields {
+		if f != "" && f != sc.idFields[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+var (
+	reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sensor_exporter_config_last_reload_successful",
+		Help: "whether the last config reload attempt was successful",
+	})
+	reloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sensor_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "time of the last successful config reload",
+	})
+)
+
+var reloadLock sync.Mutex
+
+// mark the config read on startup as successfully loaded
+func ConfigLoaded() {
+	reloadSuccess.Set(1)
+	reloadTimestamp.SetToCurrentTime()
+}
+
+// re-read config file and replace labels, calibrations and ignore rules,
+// an invalid config is rejected and the current one is kept
+func ReloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	log.Infof("CONFIG: reloading %s", *flagConfigFile)
+
+	newConfig, err := ParseConfigJSON(*flagConfigFile)
+	if err != nil {
+		log.Errorf("CONFIG: error reloading config, keeping current one: %s", err)
+		reloadSuccess.Set(0)
+		return err
+	}
+
+	// devices are only initialized on startup
+	newDevCfgs, _ := json.Marshal(newConfig.DeviceConfigs)
+	oldDevCfgs, _ := json.Marshal(config.DeviceConfigs)
+	if string(newDevCfgs) != string(oldDevCfgs) {
+		log.Warnf("CONFIG: changes of device_configs require a restart to take effect")
+	}
+
+	CreateMetricsDescs(newConfig)
+	ConfigLoaded()
+
+	log.Infof("CONFIG: reload done")
+
+	return nil
+}
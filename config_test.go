@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabelsMatchConfig(t *testing.T) {
+	tests := []struct {
+		model    string
+		id       string
+		labels   []string // device type, device id, vendor, name, sensor model and id
+		matches  bool
+		location string // expanded sensor_location label
+	}{
+		{"Nexus-TH", "1_42", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "1_42"}, true, "room"},
+		{"Nexus-TH", "1_42", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "1_43"}, false, ""},
+		{"Nexus-TH", "", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_7"}, true, "room"},
+		{"Nexus-*", "?_*", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_7"}, true, "room"},
+		{"Nexus-*", "?_*", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "12_7"}, false, ""},
+		{"Nexus-*", "", []string{"rtl_433", "433MHz", "", "", "Prologue-TH", "2_7"}, false, ""},
+		// anchors apply to each field, not to the joined fields
+		{"re:^Nexus.*", "re:.*7$", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_7"}, true, "room"},
+		{"re:^Nexus.*", "re:.*7$", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_77x"}, false, ""},
+		{"re:.*TH$", "", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_7"}, true, "room"},
+		{"re:Nexus", "", []string{"rtl_433", "433MHz", "", "", "Nexus-TH", "2_7"}, false, ""},
+		{"re:Nexus|Prologue", "", []string{"rtl_433", "433MHz", "", "", "Prologue", "2_7"}, true, "room"},
+	}
+
+	for _, test := range tests {
+		sc := &SensorConfig{SensorModel: test.model, SensorId: test.id, Labels: map[string]string{"sensor_location": "room"}}
+		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
+
+		err := sc.compileMatcher()
+		if err != nil {
+			t.Errorf("%s/%s: %s", test.model, test.id, err)
+			continue
+		}
+
+		matches, expand := labelsMatchConfig(sc, test.labels)
+		if matches != test.matches {
+			t.Errorf("%s/%s: matches %v = %v, expected %v", test.model, test.id, test.labels, matches, test.matches)
+			continue
+		}
+		if !matches {
+			continue
+		}
+
+		location := sc.Labels["sensor_location"]
+		if expand != nil {
+			location = expand(location)
+		}
+		if location != test.location {
+			t.Errorf("%s/%s: sensor_location = %s, expected %s", test.model, test.id, location, test.location)
+		}
+	}
+}
+
+func TestCompileMatcherCaptureGroups(t *testing.T) {
+	tests := []struct {
+		model    string
+		id       string
+		labels   []string
+		location string
+		matches  bool
+	}{
+		{"*-TH", "re:^(?P<channel>[0-9])_.*", []string{"", "", "", "", "Nexus-TH", "2_7"}, "Nexus room 2", true},
+		{"*-TH", "re:^(?P<channel>[0-9])_.*", []string{"", "", "", "", "Nexus-TH", "x2_7"}, "", false},
+		{"re:^(Nexus)-.*", "?_*", []string{"", "", "", "", "Nexus-TH", "3_17"}, "Nexus room 3", true},
+	}
+
+	for _, test := range tests {
+		location := "${1} room ${2}"
+		if test.model == "*-TH" {
+			location = "${1} room ${channel}"
+		}
+
+		sc := &SensorConfig{SensorModel: test.model, SensorId: test.id, Labels: map[string]string{"sensor_location": location}}
+		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
+
+		err := sc.compileMatcher()
+		if err != nil {
+			t.Errorf("%s/%s: %s", test.model, test.id, err)
+			continue
+		}
+
+		matches, expand := labelsMatchConfig(sc, test.labels)
+		if matches != test.matches {
+			t.Errorf("%s/%s: matches %v = %v, expected %v", test.model, test.id, test.labels, matches, test.matches)
+			continue
+		}
+		if matches && expand(location) != test.location {
+			t.Errorf("%s/%s: sensor_location = %s, expected %s", test.model, test.id, expand(location), test.location)
+		}
+	}
+
+	for _, re := range []string{"re:(", "re:[a-"} {
+		sc := &SensorConfig{SensorModel: re}
+		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
+
+		if sc.compileMatcher() == nil {
+			t.Errorf("%s: expected error", re)
+		}
+	}
+}
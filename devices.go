@@ -0,0 +1,182 @@
+package main
+
+// named device instances, so a driver can be used for multiple devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/sberk42/sensor_exporter/sensors"
+)
+
+// device instance selected by name with -devices, using a driver with its own config
+type DeviceInstance struct {
+	Name   string
+	Driver string
+	Config *sensors.DeviceConfig // driver specific keys
+}
+
+// device_configs is either a list of instances with name, driver and the driver keys, or
+// (for compatibility) a map from driver to its keys, using the driver as instance name
+type DeviceConfigs []*DeviceInstance
+
+func (dc *DeviceConfigs) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '{' {
+		var byDriver map[string]*sensors.DeviceConfig
+		err := json.Unmarshal(data, &byDriver)
+		if err != nil {
+			return err
+		}
+
+		*dc = make(DeviceConfigs, 0, len(byDriver))
+		for driver, cfg := range byDriver {
+			*dc = append(*dc, &DeviceInstance{driver, driver, cfg})
+		}
+		sort.Slice(*dc, func(i, j int) bool { return (*dc)[i].Name < (*dc)[j].Name })
+
+		return nil
+	}
+
+	var cfgs []*sensors.DeviceConfig
+	err := json.Unmarshal(data, &cfgs)
+	if err != nil {
+		return err
+	}
+
+	*dc = make(DeviceConfigs, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			return fmt.Errorf("device_configs[%d]: missing device config", i)
+		}
+
+		inst := &DeviceInstance{Config: cfg}
+
+		err = cfg.Get("driver", &inst.Driver)
+		if err != nil {
+			return fmt.Errorf("device_configs[%d]: %s", i, err)
+		}
+		if inst.Driver == "" {
+			return fmt.Errorf("device_configs[%d]: no driver set", i)
+		}
+
+		inst.Name = inst.Driver
+		err = cfg.Get("name", &inst.Name)
+		if err != nil {
+			return fmt.Errorf("device_configs[%d]: %s", i, err)
+		}
+
+		delete(*cfg, "driver")
+		delete(*cfg, "name")
+
+		*dc = append(*dc, inst)
+	}
+
+	return nil
+}
+
+// written as map if there is only one instance per driver
+func (dc DeviceConfigs) MarshalJSON() ([]byte, error) {
+	byDriver := make(map[string]*sensors.DeviceConfig)
+	for _, inst := range dc {
+		if inst.Name != inst.Driver {
+			byDriver = nil
+			break
+		}
+		byDriver[inst.Driver] = inst.Config
+	}
+
+	if byDriver != nil {
+		return json.Marshal(byDriver)
+	}
+
+	cfgs := make([]sensors.DeviceConfig, 0, len(dc))
+	for _, inst := range dc {
+		cfg := sensors.DeviceConfig{}
+		if inst.Config != nil {
+			for k, v := range *inst.Config {
+				cfg[k] = v
+			}
+		}
+		cfg["name"], _ = json.Marshal(inst.Name)
+		cfg["driver"], _ = json.Marshal(inst.Driver)
+
+		cfgs = append(cfgs, cfg)
+	}
+
+	return json.Marshal(cfgs)
+}
+
+// config passed to the driver, device_id defaults to the name for instances not named like their
+// driver, so multiple instances of a driver report distinct ids
+func (inst *DeviceInstance) deviceConfig() *sensors.DeviceConfig {
+	cfg := sensors.DeviceConfig{}
+	if inst.Config != nil {
+		for k, v := range *inst.Config {
+			cfg[k] = v
+		}
+	}
+
+	if _, ok := cfg["device_id"]; !ok && inst.Name != inst.Driver {
+		cfg["device_id"], _ = json.Marshal(inst.Name)
+	}
+
+	return &cfg
+}
+
+func (dc DeviceConfigs) instance(name string) *DeviceInstance {
+	for _, inst := range dc {
+		if inst.Name == name {
+			return inst
+		}
+	}
+
+	return nil
+}
+
+// get instances to initialize by name, drivers without configured instance can be used by their name
+func (dc DeviceConfigs) selectInstances(names []string) ([]*DeviceInstance, error) {
+	if len(names) == 1 && names[0] == "ALL" {
+		names = make([]string, 0)
+		for _, inst := range dc {
+			names = append(names, inst.Name)
+		}
+
+		for driver := range sensors.SupportedSensorDevices {
+			if !dc.usesDriver(driver) && dc.instance(driver) == nil {
+				names = append(names, driver)
+			}
+		}
+		sort.Strings(names[len(dc):])
+	}
+
+	instances := make([]*DeviceInstance, 0, len(names))
+	for _, name := range names {
+		inst := dc.instance(name)
+		if inst == nil {
+			_, ok := sensors.SupportedSensorDevices[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown device '%s' - use list-devices to check supported devices", name)
+			}
+
+			inst = &DeviceInstance{name, name, nil}
+		}
+
+		instances = append(instances, inst)
+	}
+
+	return instances, nil
+}
+
+func (dc DeviceConfigs) usesDriver(driver string) bool {
+	for _, inst := range dc {
+		if inst.Driver == driver {
+			return true
+		}
+	}
+
+	return false
+}
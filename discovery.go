@@ -0,0 +1,216 @@
+package main
+
+// listing of all sensors seen by the devices, to help writing sensor configs
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sberk42/sensor_exporter/sensors"
+	log "github.com/sirupsen/logrus"
+)
+
+type discoveredSensor struct {
+	SensorModel string            `json:"sensor_model"`
+	SensorId    string            `json:"sensor_id"`
+	Channel     string            `json:"channel,omitempty"`
+	Fields      []string          `json:"fields"`
+	Packets     float64           `json:"packets"`
+	Duplicates  float64           `json:"duplicates"`
+	FirstSeen   time.Time         `json:"first_seen"`
+	LastSeen    time.Time         `json:"last_seen"`
+	Configs     []int             `json:"sensor_configs"` // indexes of matching sensor configs
+	Ignored     bool              `json:"ignored"`
+	Labels      map[string]string `json:"labels"`
+}
+
+type discoveredDevice struct {
+	DeviceType   string             `json:"device_type"`
+	DeviceId     string             `json:"device_id"`
+	DeviceVendor string             `json:"device_vendor"`
+	DeviceName   string             `json:"device_name"`
+	Sensors      []discoveredSensor `json:"sensors"`
+}
+
+func discoverSensors(sds []sensors.SensorDevice) []discoveredDevice {
+	mc := currentMetricsConfig()
+
+	devices := make([]discoveredDevice, 0, len(sds))
+	for _, sd := range sds {
+		dev := discoveredDevice{sd.DeviceType(), sd.DeviceId(), sd.DeviceVendor(), sd.DeviceName(), make([]discoveredSensor, 0)}
+
+		for _, si := range sd.GetSensors() {
+			ds := discoveredSensor{SensorModel: si.SensorModel, SensorId: si.SensorId, Fields: si.Fields,
+				Packets: si.Count, Duplicates: si.Duplicates, FirstSeen: si.FirstSeen, LastSeen: si.LastSeen, Configs: make([]int, 0)}
+
+			if si.LastMessage != nil && si.LastMessage["channel"] != nil {
+				ds.Channel = asString(si.LastMessage["channel"])
+			}
+
+			labels, matched := mc.createMeasurementLabels(sd, si.SensorModel, si.SensorId)
+			if matched != nil {
+				ds.Ignored = matched.ignore
+				for _, sc := range matched.configs {
+					ds.Configs = append(ds.Configs, indexOfConfig(mc.config, sc))
+				}
+			}
+
+			ds.Labels = make(map[string]string)
+			for i, l := range labels {
+				if l != "" {
+					ds.Labels[mc.metricLabels[i]] = l
+				}
+			}
+
+			dev.Sensors = append(dev.Sensors, ds)
+		}
+
+		sort.Slice(dev.Sensors, func(i, j int) bool {
+			if dev.Sensors[i].SensorModel != dev.Sensors[j].SensorModel {
+				return dev.Sensors[i].SensorModel < dev.Sensors[j].SensorModel
+			}
+			return dev.Sensors[i].SensorId < dev.Sensors[j].SensorId
+		})
+
+		devices = append(devices, dev)
+	}
+
+	return devices
+}
+
+func indexOfConfig(cfg *ExporterConfig, sc *SensorConfig) int {
+	for i, c := range cfg.SensorConfigs {
+		if c == sc {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func asString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return strings.Trim(string(b), `"`)
+}
+
+var sensorsTemplate = template.Must(template.New("sensors").Parse(`<!DOCTYPE html>
+<html>
+<head><title>sensor_exporter - sensors</title>
+<style>table { border-collapse: collapse; } th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }</style>
+</head>
+<body>
+{{range .}}
+<h2>{{.DeviceType}}: {{.DeviceName}} ({{.DeviceId}}, {{.DeviceVendor}})</h2>
+<table>
+<tr><th>model</th><th>id</th><th>channel</th><th>fields</th><th>packets</th><th>duplicates</th><th>first seen</th><th>last seen</th><th>sensor_configs</th><th>ignored</th><th>labels</th></tr>
+{{range .Sensors}}
+<tr><td>{{.SensorModel}}</td><td>{{.SensorId}}</td><td>{{.Channel}}</td><td>{{range .Fields}}{{.}} {{end}}</td><td>{{.Packets}}</td><td>{{.Duplicates}}</td>
+<td>{{.FirstSeen.Format "2006-01-02 15:04:05"}}</td><td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td>
+<td>{{range .Configs}}{{.}} {{else}}none{{end}}</td><td>{{if .Ignored}}yes{{end}}</td>
+<td>{{range $l, $v := .Labels}}{{$l}}="{{$v}}" {{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+<p><a href="?format=json">JSON</a></p>
+</body>
+</html>
+`))
+
+// list sensors as HTML table or as JSON with format=json
+func sensorsHandler(sds []sensors.SensorDevice) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		devices := discoverSensors(sds)
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+
+			err := enc.Encode(devices)
+			if err != nil {
+				log.Errorf("Error writing sensors: %s", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := sensorsTemplate.Execute(w, devices)
+		if err != nil {
+			log.Errorf("Error writing sensors: %s", err)
+		}
+	}
+}
+
+// config generated by discover mode, only fields needed to identify the sensors are written
+type skeletonSensorConfig struct {
+	DeviceType  string            `json:"deviceType,omitempty"`
+	DeviceId    string            `json:"deviceId,omitempty"`
+	SensorModel string            `json:"sensorModel,omitempty"`
+	SensorId    string            `json:"sensorId,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Ignore      bool              `json:"ignore,omitempty"`
+	count       float64
+}
+
+type skeletonConfig struct {
+	DeviceConfigs DeviceConfigs           `json:"device_configs,omitempty"`
+	SensorConfigs []*skeletonSensorConfig `json:"sensor_configs"`
+}
+
+// create config with one sensor config per seen sensor, sorted by packets received,
+// sensors received less than a quarter as often as the median are marked ignored
+func createConfigSkeleton(deviceConfigs DeviceConfigs, sds []sensors.SensorDevice) *skeletonConfig {
+	skel := &skeletonConfig{deviceConfigs, make([]*skeletonSensorConfig, 0)}
+
+	for _, sd := range sds {
+		for _, si := range sd.GetSensors() {
+			ssc := &skeletonSensorConfig{DeviceType: sd.DeviceType(), DeviceId: sd.DeviceId(), SensorModel: si.SensorModel, SensorId: si.SensorId,
+				Labels: map[string]string{"sensor_location": "TODO"}, count: si.Count}
+
+			skel.SensorConfigs = append(skel.SensorConfigs, ssc)
+		}
+	}
+
+	sort.SliceStable(skel.SensorConfigs, func(i, j int) bool {
+		return skel.SensorConfigs[i].count > skel.SensorConfigs[j].count
+	})
+
+	if len(skel.SensorConfigs) > 0 {
+		median := skel.SensorConfigs[len(skel.SensorConfigs)/2].count
+		for _, ssc := range skel.SensorConfigs {
+			if ssc.count < median/4 {
+				ssc.Ignore = true
+				ssc.Labels = nil
+			}
+		}
+	}
+
+	return skel
+}
+
+// listen for the given time and print config skeleton for all sensors seen
+func discover(duration time.Duration, deviceConfigs DeviceConfigs, sds []sensors.SensorDevice) error {
+	log.Infof("DISCOVER: listening for sensors for %s", duration)
+	time.Sleep(duration)
+
+	skel := createConfigSkeleton(deviceConfigs, sds)
+	log.Infof("DISCOVER: found %d sensors", len(skel.SensorConfigs))
+
+	jsonData, err := json.MarshalIndent(skel, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(jsonData))
+
+	return nil
+}
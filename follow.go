@@ -0,0 +1,169 @@
+package main
+
+/* some sensors (e.g. Ambientweather or Oregon) choose a new random id on every
+ * battery change, configs with followNewId are bound to model and channel and
+ * switch to the new id, for other configs the new sensor is reported as
+ * replacement candidate
+ */
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sberk42/sensor_exporter/sensors"
+	log "github.com/sirupsen/logrus"
+)
+
+var followLock sync.RWMutex
+
+// sensors last seen before the start (restored from the state) are not replaced, as the
+// configured sensor may just not have reported yet
+var startTime = time.Now()
+
+// config identifies a single sensor, not a group of them
+func (sc *SensorConfig) identifiesSensor() bool {
+	return sc.matcher == nil && sc.SensorModel != "" && sc.SensorId != ""
+}
+
+// id of the sensor matched by the config, differs from sensorId after following a new id
+func (sc *SensorConfig) currentSensorId() string {
+	if !sc.FollowNewId {
+		return sc.SensorId
+	}
+
+	followLock.RLock()
+	defer followLock.RUnlock()
+
+	if sc.followedId != "" {
+		return sc.followedId
+	}
+
+	return sc.SensorId
+}
+
+func (sc *SensorConfig) followSensorId(id string) {
+	followLock.Lock()
+	defer followLock.Unlock()
+
+	sc.followedId = id
+}
+
+// channel part of sensor ids like <channel>_<id>, empty for sensors without channel
+func sensorChannel(sensorId string) string {
+	i := strings.LastIndex(sensorId, "_")
+	if i == -1 {
+		return ""
+	}
+
+	return sensorId[:i]
+}
+
+// sensor currently reporting, which is not identified by any config
+type unconfiguredSensor struct {
+	ids  []string
+	info sensors.SensorInfo
+}
+
+func unconfiguredSensorIds(sd sensors.SensorDevice, si sensors.SensorInfo, matched *matchedConfig) *unconfiguredSensor {
+	if matched != nil {
+		for _, sc := range matched.configs {
+			if sc.identifiesSensor() {
+				return nil
+			}
+		}
+	}
+
+	ids := []string{sd.DeviceType(), sd.DeviceId(), sd.DeviceVendor(), sd.DeviceName(), si.SensorModel, si.SensorId}
+
+	return &unconfiguredSensor{ids, si}
+}
+
+// find unconfigured sensors with same model and channel as configured sensors not reporting anymore,
+// configs following new ids are switched to the candidate, if there is only one
+func (mc *metricsConfig) findReplacedSensors(lastSeenConfigs map[*SensorConfig]time.Time, unconfigured []*unconfiguredSensor, now time.Time) map[*SensorConfig][]string {
+	replaced := make(map[*SensorConfig][]string)
+
+	for _, sc := range mc.config.SensorConfigs {
+		if sc.ignored() || !sc.identifiesSensor() {
+			continue
+		}
+
+		// only sensors seen since the start, which stopped reporting, never seen ones
+		// might just not have reported yet
+		lastSeen := lastSeenConfigs[sc]
+		if lastSeen.Before(startTime) || now.Sub(lastSeen) <= sensors.MeasurementTTL {
+			continue
+		}
+
+		id := sc.currentSensorId()
+		channel := sensorChannel(id)
+
+		var candidates []*unconfiguredSensor
+		for _, us := range unconfigured {
+			if sensorChannel(us.ids[5]) != channel {
+				continue
+			}
+
+			ids := append([]string{}, us.ids...)
+			ids[5] = id
+
+			ok, _ := labelsMatchConfig(sc, ids)
+			if ok {
+				candidates = append(candidates, us)
+			}
+		}
+
+		if len(candidates) == 0 {
+			continue
+		}
+
+		if sc.FollowNewId && len(candidates) == 1 {
+			log.Infof("PROM: sensor %s_%s not reporting anymore, following new id %s", sc.SensorModel, id, candidates[0].ids[5])
+			sc.followSensorId(candidates[0].ids[5])
+			continue
+		}
+
+		for _, us := range candidates {
+			replaced[sc] = append(replaced[sc], us.ids[5])
+			sc.logCandidate(id, us.ids[5])
+		}
+	}
+
+	return replaced
+}
+
+// log each candidate only once, as this is checked on every scrape
+func (sc *SensorConfig) logCandidate(id string, candidateId string) {
+	followLock.Lock()
+	defer followLock.Unlock()
+
+	if sc.candidates == nil {
+		sc.candidates = make(map[string]bool)
+	}
+
+	if !sc.candidates[candidateId] {
+		sc.candidates[candidateId] = true
+		log.Warnf("PROM: configured sensor %s_%s not reporting anymore, unconfigured sensor %s_%s with same channel appeared - id changed?",
+			sc.SensorModel, id, sc.SensorModel, candidateId)
+	}
+}
+
+// keep followed ids of configs with same id fields on reload
+func keepFollowedIds(oldCfg *ExporterConfig, newCfg *ExporterConfig) {
+	followLock.Lock()
+	defer followLock.Unlock()
+
+	for _, newSc := range newCfg.SensorConfigs {
+		if !newSc.FollowNewId {
+			continue
+		}
+
+		for _, oldSc := range oldCfg.SensorConfigs {
+			if oldSc.FollowNewId && sameIdFields(oldSc, newSc) {
+				newSc.followedId = oldSc.followedId
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sberk42/sensor_exporter/sensors"
+)
+
+func TestFindReplacedSensors(t *testing.T) {
+	now := time.Now().Add(time.Hour)
+	gone := now.Add(-sensors.MeasurementTTL - time.Minute)
+
+	tests := []struct {
+		name     string
+		follow   bool
+		lastSeen time.Time // of the configured sensor, zero if never seen
+		followed string
+		replaced []string
+	}{
+		{"never seen", true, time.Time{}, "3_195", nil},
+		{"reporting", true, now.Add(-time.Minute), "3_195", nil},
+		{"seen before start", true, startTime.Add(-time.Minute), "3_195", nil},
+		{"not reporting anymore", true, gone, "3_77", nil},
+		{"candidate never seen", false, time.Time{}, "3_195", nil},
+		{"candidate", false, gone, "3_195", []string{"3_77"}},
+	}
+
+	for _, test := range tests {
+		sc := &SensorConfig{SensorModel: "Ambientweather-F007TH", SensorId: "3_195", FollowNewId: test.follow}
+		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
+		mc := &metricsConfig{config: &ExporterConfig{SensorConfigs: []*SensorConfig{sc}}}
+
+		lastSeenConfigs := make(map[*SensorConfig]time.Time)
+		if !test.lastSeen.IsZero() {
+			lastSeenConfigs[sc] = test.lastSeen
+		}
+
+		unconfigured := []*unconfiguredSensor{
+			{ids: []string{"rtl_433", "", "", "", "Ambientweather-F007TH", "3_77"}},
+			{ids: []string{"rtl_433", "", "", "", "Ambientweather-F007TH", "2_12"}},
+		}
+
+		replaced := mc.findReplacedSensors(lastSeenConfigs, unconfigured, now)
+		if sc.currentSensorId() != test.followed {
+			t.Errorf("%s: current id = %s, expected %s", test.name, sc.currentSensorId(), test.followed)
+		}
+		if len(replaced[sc]) != len(test.replaced) || (len(test.replaced) > 0 && replaced[sc][0] != test.replaced[0]) {
+			t.Errorf("%s: replacement candidates = %v, expected %v", test.name, replaced[sc], test.replaced)
+		}
+	}
+}
@@ -5,7 +5,7 @@ go 1.16
 require (
 	github.com/google/gousb v1.1.2
 	github.com/prometheus/client_golang v1.15.1
-	github.com/prometheus/common v0.43.0 // indirect
+	github.com/prometheus/common v0.43.0
 	github.com/sirupsen/logrus v1.9.2
 	golang.org/x/sys v0.8.0 // indirect
 )
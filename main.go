@@ -23,7 +23,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sberk42/sensor_exporter/sensors"
 	log "github.com/sirupsen/logrus"
@@ -31,10 +34,15 @@ import (
 
 var (
 	flagListDevs   = flag.Bool("list-devices", false, "List supported devices and exit.")
-	flagDevices    = flag.String("devices", "ALL", "Comma seperated list of device IDs to initialize (see list-devices for known IDs)")
+	flagCheck      = flag.Bool("check-config", false, "Check config file and exit.")
+	flagDevices    = flag.String("devices", "ALL", "Comma seperated list of devices to initialize, names of device_configs or drivers (see list-devices for known drivers)")
 	flagConfigFile = flag.String("config-file", "sensor_exporter.json", "The JSON file with the metric definitions.")
 	flagAddr       = flag.String("listen-address", "127.0.0.1:9043", "The address to listen on for HTTP requests.")
 	flagLogLevel   = flag.String("log-level", "info", "The log level {trace|debug|info|warn|error}")
+	flagTTL        = flag.Duration("measurement-ttl", 5*time.Minute, "Time after which measurements of a sensor not reporting anymore are dropped.")
+	flagStateFile  = flag.String("state-file", "", "File to persist counters and sensor values across restarts (disabled if empty).")
+	flagStateIntv  = flag.Duration("state-interval", time.Minute, "Interval for saving the state file.")
+	flagDiscover   = flag.Duration("discover", 0, "Listen for the given time and print a config skeleton for all sensors seen.")
 )
 
 var config *ExporterConfig
@@ -44,7 +52,10 @@ func init() {
 	for _, sensorDev := range sensors.SupportedSensorDevices {
 		sensorDev.InitFlagsFunction()
 	}
+}
 
+func main() {
+	// parsed in main, so flags of go test are not parsed as ours
 	flag.Parse()
 
 	// init log level
@@ -53,13 +64,11 @@ func init() {
 
 	logLevel, err := log.ParseLevel(*flagLogLevel)
 	if err != nil {
-		log.Fatalf("error parsing log level:", err)
+		log.Fatalf("error parsing log level: %s", err)
 	} else {
 		log.SetLevel(logLevel)
 	}
-}
 
-func main() {
 	if *flagListDevs {
 		fmt.Println("Supported Devices:")
 		for id, dev := range sensors.SupportedSensorDevices {
@@ -70,38 +79,76 @@ func main() {
 	}
 
 	// read config
-	var err error
 	config, err = ParseConfigJSON(*flagConfigFile)
+	if *flagCheck {
+		if err != nil {
+			fmt.Printf("%s: %s\n", *flagConfigFile, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s: config OK\n", *flagConfigFile)
+		return
+	}
+
+	if *flagDiscover > 0 {
+		// config is printed on stdout, so move log to stderr
+		log.SetOutput(os.Stderr)
+
+		// start without config, if it does not exist yet or is empty (e.g. truncated by
+		// redirecting the output to it)
+		fi, statErr := os.Stat(*flagConfigFile)
+		if os.IsNotExist(statErr) || (statErr == nil && fi.Size() == 0) {
+			config, err = &ExporterConfig{}, nil
+		}
+	}
+
 	if err != nil {
-		log.Fatalf("error reading config file:", err)
+		log.Fatalf("error reading config file: %s", err)
 	}
 
-	CreateMetricsDescs()
+	sensors.MeasurementTTL = *flagTTL
+
+	CreateMetricsDescs(config)
+	ConfigLoaded()
+
+	// reload config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ReloadConfig()
+		}
+	}()
 
 	// init sensors
-	sIDs := strings.Split(*flagDevices, ",")
-	if sIDs[0] == "ALL" {
-		sIDs = make([]string, 0)
-		for id := range sensors.SupportedSensorDevices {
-			sIDs = append(sIDs, id)
+	instances, err := config.DeviceConfigs.selectInstances(strings.Split(*flagDevices, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// state is restored by the devices before they start collecting
+	state := &ExporterState{}
+	if *flagStateFile != "" && *flagDiscover == 0 {
+		state, err = LoadState(*flagStateFile)
+		if err != nil {
+			log.Errorf("error reading state file - starting without state: %s", err)
+			state = &ExporterState{}
 		}
 	}
-	log.Debugf("initializing devices: %v", sIDs)
 
 	var sds []sensors.SensorDevice
-	for _, id := range sIDs {
-		sensorDev, ok := sensors.SupportedSensorDevices[id]
-		if !ok {
-			log.Fatalf("Unknown sensor device '%s' - use list-devices to check supported devices", id)
-		}
+	devices := make(map[string]sensors.SensorDevice)
+	for _, inst := range instances {
+		log.Debugf("initializing device %s (%s)", inst.Name, inst.Driver)
 
-		dev, err := sensorDev.InitFunction(config.DeviceConfigs[id])
+		dev, err := sensors.SupportedSensorDevices[inst.Driver].InitFunction(inst.deviceConfig(), state.Devices[inst.Name])
 		if err != nil {
-			log.Errorf("cannot init sensor: %s", err)
+			log.Errorf("cannot init sensor %s: %s", inst.Name, err)
 		} else {
-			log.Infof("init done: %s, %s", dev.DeviceType(), dev.DeviceId())
+			log.Infof("init done: %s: %s, %s", inst.Name, dev.DeviceType(), dev.DeviceId())
 
 			sds = append(sds, dev)
+			devices[inst.Name] = dev
 		}
 	}
 
@@ -109,6 +156,21 @@ func main() {
 		log.Fatal("Failed to init any sensor device")
 	}
 
+	if *flagDiscover > 0 {
+		err = discover(*flagDiscover, config.DeviceConfigs, sds)
+		if err != nil {
+			log.Fatalf("error creating config: %s", err)
+		}
+
+		return
+	}
+
+	if *flagStateFile != "" {
+		state.restoreConfigState()
+
+		StartStatePersistence(*flagStateFile, *flagStateIntv, devices)
+	}
+
 	// register collected sensors
 	RegisterCollectorAndServeMetrics(sds, *flagAddr)
 }
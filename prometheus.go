@@ -3,7 +3,10 @@ package main
 // prometheus metrics creation and collection
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,10 +14,40 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var metricDescs map[sensors.MeasurementType]*prometheus.Desc
-var metricTypes map[sensors.MeasurementType]prometheus.ValueType
-var metricLabels []string
-var configLabelIndex map[string]int
+// metrics and labels created from a config, replaced as a whole on config reload
+type metricsConfig struct {
+	config           *ExporterConfig
+	metricDescs      map[sensors.MeasurementType]*prometheus.Desc
+	metricTypes      map[sensors.MeasurementType]prometheus.ValueType
+	metricDescsLock  sync.RWMutex // descs for types registered while collecting are added later
+	metricLabels     []string
+	configLabelIndex map[string]int
+
+	// metrics describing the state of configured sensors
+	lastSeenDesc *prometheus.Desc
+	upDesc       *prometheus.Desc
+	ageDesc      *prometheus.Desc
+	droppedDesc  *prometheus.Desc
+	replacedDesc *prometheus.Desc
+	decoderDesc  *prometheus.Desc
+	framesDesc   *prometheus.Desc
+}
+
+// labels set from device and measurement, matched by the id fields of sensor configs
+var builtinLabels = []string{"device_type", "device_id", "device_vendor", "device_name", "sensor_model", "sensor_id"}
+
+var metricsCfg *metricsConfig
+var metricsCfgLock sync.RWMutex
+
+// collect might be called concurrently by multiple scrapers
+var ignoreLock sync.Mutex
+
+func currentMetricsConfig() *metricsConfig {
+	metricsCfgLock.RLock()
+	defer metricsCfgLock.RUnlock()
+
+	return metricsCfg
+}
 
 type SensorCollector struct {
 	sensorDevices []sensors.SensorDevice
@@ -22,115 +55,322 @@ type SensorCollector struct {
 
 // Implement prometheus Collector
 func (sc *SensorCollector) Describe(ch chan<- *prometheus.Desc) {
-	for _, md := range metricDescs {
+	mc := currentMetricsConfig()
+
+	mc.metricDescsLock.RLock()
+	for _, md := range mc.metricDescs {
 		ch <- md
 	}
+	mc.metricDescsLock.RUnlock()
+
+	ch <- mc.lastSeenDesc
+	ch <- mc.upDesc
+	ch <- mc.ageDesc
+	ch <- mc.droppedDesc
+	ch <- mc.replacedDesc
+	ch <- mc.decoderDesc
+	ch <- mc.framesDesc
 }
 
-func labelsMatchConfig(sc *SensorConfig, labels []string) bool {
+// check whether labels match config, for configs using patterns also a function
+// expanding references to their capture groups in label values is returned
+func labelsMatchConfig(sc *SensorConfig, labels []string) (bool, func(string) string) {
+
+	if sc.matcher != nil {
+		src, m := sc.matchFields(labels[:len(sc.idFields)])
+		if m == nil {
+			return false, nil
+		}
+
+		return true, func(v string) string {
+			return string(sc.matcher.ExpandString(nil, v, src, m))
+		}
+	}
 
 	for i, l := range sc.idFields {
+		if i == 5 && sc.FollowNewId {
+			l = sc.currentSensorId()
+		}
 		if l != "" && l != labels[i] {
-			return false
+			return false, nil
 		}
 	}
 
-	return true
+	return true, nil
 }
 
-func createMeasurementLabels(dev sensors.SensorDevice, m *sensors.Measurement) ([]string, *SensorConfig) {
+// settings of all sensor configs matching a sensor
+type matchedConfig struct {
+	configs      []*SensorConfig
+	ignore       bool
+	ignoredBy    *SensorConfig // config setting the ignore flag, used for counting ignored values
+	calibrations map[string]*Calibration
+}
+
+// add labels and settings of a matching config, overriding the ones already set
+func (matched *matchedConfig) apply(sc *SensorConfig, labels []string, expand func(string) string, labelIndex map[string]int) {
+	matched.configs = append(matched.configs, sc)
+
+	for l, v := range sc.Labels {
+		if expand != nil {
+			v = expand(v)
+		}
+		labels[labelIndex[l]] = v
+	}
+
+	if sc.Ignore != nil {
+		matched.ignore = *sc.Ignore
+		matched.ignoredBy = sc
+	}
+
+	if len(sc.Calibrations) > 0 {
+		if matched.calibrations == nil {
+			matched.calibrations = make(map[string]*Calibration)
+		}
+
+		for m, cal := range sc.Calibrations {
+			matched.calibrations[m] = cal
+		}
+	}
+}
+
+func (mc *metricsConfig) createMeasurementLabels(dev sensors.SensorDevice, sensorModel string, sensorId string) ([]string, *matchedConfig) {
 	// create static labels from device and measurement
-	labels := make([]string, len(metricLabels))
+	labels := make([]string, len(mc.metricLabels))
 	labels[0] = dev.DeviceType()
 	labels[1] = dev.DeviceId()
 	labels[2] = dev.DeviceVendor()
 	labels[3] = dev.DeviceName()
-	labels[4] = m.SensorModel
-	labels[5] = m.SensorId
+	labels[4] = sensorModel
+	labels[5] = sensorId
+
+	if mc.config.MergeSensorConfigs {
+		return labels, mc.mergeMatchingConfigs(labels)
+	}
 
 	// get labels from config
-	for _, sc := range config.SensorConfigs {
-		if labelsMatchConfig(sc, labels) {
-			// add static labels
-			for l, v := range sc.Labels {
-				labels[configLabelIndex[l]] = v
-			}
+	for _, sc := range mc.config.SensorConfigs {
+		ok, expand := labelsMatchConfig(sc, labels)
+		if ok {
+			matched := &matchedConfig{}
+			matched.apply(sc, labels, expand, mc.configLabelIndex)
 
-			return labels, sc
+			return labels, matched
 		}
 	}
 
 	return labels, nil
 }
 
-func createConfigLabels(sc *SensorConfig) []string {
+// merge all matching configs, from general to specific ones
+func (mc *metricsConfig) mergeMatchingConfigs(labels []string) *matchedConfig {
+	var matched *matchedConfig
+
+	// configs may override built-in labels, so keep the original ones for matching
+	ids := append([]string{}, labels[:len(builtinLabels)]...)
+
+	for _, sc := range mc.config.mergeOrder {
+		ok, expand := labelsMatchConfig(sc, ids)
+		if ok {
+			if matched == nil {
+				matched = &matchedConfig{}
+			}
+			matched.apply(sc, labels, expand, mc.configLabelIndex)
+		}
+	}
+
+	return matched
+}
+
+func (mc *metricsConfig) createConfigLabels(sc *SensorConfig) []string {
 	// create static labels from device and measurement
-	labels := make([]string, len(metricLabels))
+	labels := make([]string, len(mc.metricLabels))
 	labels[0] = sc.DeviceType
 	labels[1] = sc.DeviceId
 	labels[2] = sc.DeviceVendor
 	labels[3] = sc.DeviceName
 	labels[4] = sc.SensorModel
-	labels[5] = sc.SensorId
+	labels[5] = sc.currentSensorId()
 
 	// add static labels
 	for l, v := range sc.Labels {
-		labels[configLabelIndex[l]] = v
+		labels[mc.configLabelIndex[l]] = v
 	}
 
 	return labels
 }
 
+// count each ignored value once, no matter how often it is scraped
+func countIgnored(sdConfig *SensorConfig, dev sensors.SensorDevice, m *sensors.Measurement) {
+	ignoreLock.Lock()
+	defer ignoreLock.Unlock()
+
+	if sdConfig.ignoredSeen == nil {
+		sdConfig.ignoredSeen = make(map[string]time.Time)
+	}
+
+	key := dev.DeviceType() + "_" + dev.DeviceId() + "_" + m.SensorModel + "_" + m.SensorId
+	if m.Timestamp.After(sdConfig.ignoredSeen[key]) {
+		sdConfig.ignoredSeen[key] = m.Timestamp
+		sdConfig.IgnoreCount++
+	}
+}
+
+func sendMetric(ch chan<- prometheus.Metric, md *prometheus.Desc, vt prometheus.ValueType, value float64, labels []string) {
+	metric, err := prometheus.NewConstMetric(md, vt, value, labels...)
+	if err != nil {
+		log.Errorf("Error creating metric %s", err)
+	} else {
+		ch <- metric
+	}
+}
+
+type sensorValues struct {
+	labels []string
+	values map[sensors.MeasurementType]float64
+}
+
 func (sc *SensorCollector) Collect(ch chan<- prometheus.Metric) {
 
+	mc := currentMetricsConfig()
+	now := time.Now()
+	seenConfigs := make(map[*SensorConfig]bool)
+	lastSeenConfigs := make(map[*SensorConfig]time.Time) // last time a sensor matching the config was seen
+	var unconfigured []*unconfiguredSensor
+
 	for _, sd := range sc.sensorDevices {
 		ms := sd.GetMeasurements()
 
+		// calibrated values of each sensor for deriving further measurements
+		calibrated := make(map[string]*sensorValues)
+
 		for _, m := range ms {
-			md := metricDescs[m.Type]
-			vt := metricTypes[m.Type]
+			md, vt := mc.metricDesc(m.Type)
 
-			labels, sdConfig := createMeasurementLabels(sd, &m)
+			labels, sdConfig := mc.createMeasurementLabels(sd, m.SensorModel, m.SensorId)
+
+			// only measurements of sensors with model (received by rtl_433), not of the device itself
+			if sdConfig == nil && mc.config.OnlyConfiguredSensors && !m.Timestamp.IsZero() && m.SensorModel != "" {
+				log.Debugf("PROM: dropped measurement from unconfigured sensor %s: %s_%s", sd.DeviceName(), m.SensorModel, m.SensorId)
+				continue
+			}
 
 			value := m.Value
 			if sdConfig != nil {
-				if sdConfig.Ignore {
+				if sdConfig.ignore {
 					log.Debugf("PROM: ignored measurement from %s: %s_%s", sd.DeviceName(), m.SensorModel, m.SensorId)
-					sdConfig.IgnoreCount++
+					countIgnored(sdConfig.ignoredBy, sd, &m)
 					continue
 				}
 
 				md := sensors.GetMeasurementTypeDetails(m.Type)
-				cal, ok := sdConfig.Calibrations[md.MetricName]
-				if ok {
-					log.Debugf("PROM: applying calibration offset %f to %s from %s: %s_%s", cal, md.MetricName, sd.DeviceName(), m.SensorModel, m.SensorId)
-					value += cal
+				cal, ok := sdConfig.calibrations[md.MetricName]
+				if ok && !m.SensorStats {
+					log.Debugf("PROM: applying calibration %s to %s from %s: %s_%s", cal, md.MetricName, sd.DeviceName(), m.SensorModel, m.SensorId)
+					value = cal.Apply(value)
 				}
 			}
 
-			metric, err := prometheus.NewConstMetric(md, vt, value, labels...)
-			if err != nil {
-				log.Errorf("Error creating metric %s", err)
-			} else {
-				ch <- metric
+			sendMetric(ch, md, vt, value, labels)
+
+			// age and derived measurements only for values received from the sensor
+			if m.Timestamp.IsZero() || m.SensorStats {
+				continue
+			}
+
+			key := m.SensorModel + "_" + m.SensorId
+			sv, ok := calibrated[key]
+			if !ok {
+				sv = &sensorValues{labels: labels, values: make(map[sensors.MeasurementType]float64)}
+				calibrated[key] = sv
+			}
+			sv.values[m.Type] = value
+
+			// report age of values received from configured sensors
+			if sdConfig != nil {
+				mName := sensors.GetMeasurementTypeDetails(m.Type).MetricName
+				sendMetric(ch, mc.ageDesc, prometheus.GaugeValue, now.Sub(m.Timestamp).Seconds(), append(labels, mName))
 			}
 		}
+
+		for _, sv := range calibrated {
+			for mt, value := range sensors.DeriveMeasurements(sv.values) {
+				md, vt := mc.metricDesc(mt)
+				sendMetric(ch, md, vt, value, sv.labels)
+			}
+		}
+
+		// report state of configured sensors
+		droppedSensors := make(map[string]int)
+		for _, si := range sd.GetSensors() {
+			labels, sdConfig := mc.createMeasurementLabels(sd, si.SensorModel, si.SensorId)
+			isUp := now.Sub(si.LastSeen) <= sensors.MeasurementTTL
+			if sdConfig == nil && mc.config.OnlyConfiguredSensors && isUp && si.SensorModel != "" {
+				droppedSensors[si.SensorModel]++
+			}
+			if isUp {
+				us := unconfiguredSensorIds(sd, si, sdConfig)
+				if us != nil {
+					unconfigured = append(unconfigured, us)
+				}
+			}
+			if sdConfig == nil || sdConfig.ignore {
+				continue
+			}
+
+			up := 0.0
+			for _, c := range sdConfig.configs {
+				seenConfigs[c] = true
+				if si.LastSeen.After(lastSeenConfigs[c]) {
+					lastSeenConfigs[c] = si.LastSeen
+				}
+				if isUp {
+					up = 1
+				}
+			}
+
+			sendMetric(ch, mc.lastSeenDesc, prometheus.GaugeValue, float64(si.LastSeen.UnixNano())/1e9, labels)
+			sendMetric(ch, mc.upDesc, prometheus.GaugeValue, up, labels)
+		}
+
+		for model, count := range droppedSensors {
+			labels := []string{sd.DeviceType(), sd.DeviceId(), sd.DeviceVendor(), sd.DeviceName(), model}
+			sendMetric(ch, mc.droppedDesc, prometheus.GaugeValue, float64(count), labels)
+		}
+
+		dsp, ok := sd.(sensors.DecoderStatsProvider)
+		if ok {
+			mc.collectDecoderStats(ch, sd, dsp.GetDecoderStats())
+		}
+	}
+
+	// configured sensors not reporting anymore, with a new sensor on the same channel
+	for sdConfig, ids := range mc.findReplacedSensors(lastSeenConfigs, unconfigured, now) {
+		labels := mc.createConfigLabels(sdConfig)
+		for _, id := range ids {
+			sendMetric(ch, mc.replacedDesc, prometheus.GaugeValue, 1, append(labels, id))
+		}
+	}
+
+	// configured sensors never seen are down, configs with patterns have no labels
+	// of a sensor to report (only the pattern and unexpanded references)
+	for _, sdConfig := range mc.config.SensorConfigs {
+		if !sdConfig.ignored() && sdConfig.matcher == nil && !seenConfigs[sdConfig] {
+			sendMetric(ch, mc.upDesc, prometheus.GaugeValue, 0, mc.createConfigLabels(sdConfig))
+		}
 	}
 
 	// now report ignored values
-	md := metricDescs[sensors.IGNORED_COUNTER]
-	vt := metricTypes[sensors.IGNORED_COUNTER]
-	for _, sc := range config.SensorConfigs {
-		if sc.IgnoreCount > 0 {
-
-			labels := createConfigLabels(sc)
-
-			metric, err := prometheus.NewConstMetric(md, vt, float64(sc.IgnoreCount), labels...)
-			if err != nil {
-				log.Errorf("Error creating metric %s", err)
-			} else {
-				ch <- metric
-			}
+	md, vt := mc.metricDesc(sensors.IGNORED_COUNTER)
+	ignoreLock.Lock()
+	defer ignoreLock.Unlock()
+
+	for _, sdConfig := range mc.config.SensorConfigs {
+		if sdConfig.IgnoreCount > 0 {
+
+			labels := mc.createConfigLabels(sdConfig)
+
+			sendMetric(ch, md, vt, float64(sdConfig.IgnoreCount), labels)
 		}
 	}
 }
@@ -145,51 +385,146 @@ func indexOf(slice []string, item string) int {
 	return -1
 }
 
-func CreateMetricsDescs() {
+// create metrics for config and make them the current ones used for collecting
+func CreateMetricsDescs(cfg *ExporterConfig) {
 	mtypes := sensors.GetAllMeasurementTypes()
 
-	metricDescs = make(map[sensors.MeasurementType]*prometheus.Desc, len(mtypes))
-	metricTypes = make(map[sensors.MeasurementType]prometheus.ValueType, len(mtypes))
-	configLabelIndex = make(map[string]int)
+	mc := &metricsConfig{config: cfg}
+	mc.metricDescs = make(map[sensors.MeasurementType]*prometheus.Desc, len(mtypes))
+	mc.metricTypes = make(map[sensors.MeasurementType]prometheus.ValueType, len(mtypes))
+	mc.configLabelIndex = make(map[string]int)
 
-	metricLabels = []string{"device_type", "device_id", "device_vendor", "device_name", "sensor_model", "sensor_id"}
-	for i, l := range metricLabels {
-		configLabelIndex[l] = i
+	mc.metricLabels = append([]string{}, builtinLabels...)
+	for i, l := range mc.metricLabels {
+		mc.configLabelIndex[l] = i
 	}
 
-	// append constant labels from config and fill idFields
-	for _, sc := range config.SensorConfigs {
-		sc.idFields = []string{sc.DeviceType, sc.DeviceId, sc.DeviceVendor, sc.DeviceName, sc.SensorModel, sc.SensorId}
-
+	// append constant labels from config
+	for _, sc := range cfg.SensorConfigs {
 		log.Debugf("PROM: init sc to %v", sc)
 
 		for lbl := range sc.Labels {
-			if indexOf(metricLabels, lbl) == -1 {
-				configLabelIndex[lbl] = len(metricLabels)
-				metricLabels = append(metricLabels, lbl)
+			if indexOf(mc.metricLabels, lbl) == -1 {
+				mc.configLabelIndex[lbl] = len(mc.metricLabels)
+				mc.metricLabels = append(mc.metricLabels, lbl)
 			}
 		}
 	}
 
-	log.Debugf("metric labels: %v", metricLabels)
-	log.Debugf("configLabelIndex: %v", configLabelIndex)
+	log.Debugf("metric labels: %v", mc.metricLabels)
+	log.Debugf("configLabelIndex: %v", mc.configLabelIndex)
 
 	for _, mt := range mtypes {
-		mDetails := sensors.GetMeasurementTypeDetails(mt)
+		mc.addMetricDesc(mt)
+	}
+
+	mc.lastSeenDesc = prometheus.NewDesc("sensor_last_seen_timestamp_seconds", "time a configured sensor last reported values", mc.metricLabels, nil)
+	mc.upDesc = prometheus.NewDesc("sensor_up", "configured sensor reported values within measurement TTL", mc.metricLabels, nil)
+	mc.ageDesc = prometheus.NewDesc("sensor_measurement_age_seconds", "age of the value of a measurement from a configured sensor", append(append([]string{}, mc.metricLabels...), "measurement"), nil)
+	mc.droppedDesc = prometheus.NewDesc("sensor_dropped_sensors", "unconfigured sensors currently reporting, whose measurements are dropped", builtinLabels[:5], nil)
+	mc.decoderDesc = prometheus.NewDesc("sensor_decoder_counter", "results of decoding signals by protocol", append(append([]string{}, builtinLabels[:4]...), "protocol", "name", "result"), nil)
+	mc.framesDesc = prometheus.NewDesc("sensor_decoder_frames_counter", "frames received by decoders", append(append([]string{}, builtinLabels[:4]...), "type"), nil)
+	mc.replacedDesc = prometheus.NewDesc("sensor_replacement_candidate", "unconfigured sensor with same model and channel as a configured sensor not reporting anymore", append(append([]string{}, mc.metricLabels...), "candidate_sensor_id"), nil)
+
+	metricsCfgLock.Lock()
+	defer metricsCfgLock.Unlock()
+
+	if metricsCfg != nil {
+		keepIgnoreCounts(metricsCfg.config, cfg)
+		keepFollowedIds(metricsCfg.config, cfg)
+	}
+	metricsCfg = mc
+}
+
+func (mc *metricsConfig) addMetricDesc(mt sensors.MeasurementType) (*prometheus.Desc, prometheus.ValueType) {
+	mDetails := sensors.GetMeasurementTypeDetails(mt)
+
+	md := prometheus.NewDesc("sensor_measurement_"+mDetails.MetricName, mDetails.MetricHelp, mc.metricLabels, nil)
+
+	var vt prometheus.ValueType
+
+	if mDetails.MetricValue == sensors.COUNTER {
+		vt = prometheus.CounterValue
+	} else if mDetails.MetricValue == sensors.GAUGE {
+		vt = prometheus.GaugeValue
+	} else {
+		vt = prometheus.UntypedValue
+	}
+
+	mc.metricDescs[mt] = md
+	mc.metricTypes[mt] = vt
+
+	return md, vt
+}
+
+// get desc for measurement type, created if type was registered after config was loaded
+func (mc *metricsConfig) metricDesc(mt sensors.MeasurementType) (*prometheus.Desc, prometheus.ValueType) {
+	mc.metricDescsLock.RLock()
+	md, ok := mc.metricDescs[mt]
+	vt := mc.metricTypes[mt]
+	mc.metricDescsLock.RUnlock()
+
+	if ok {
+		return md, vt
+	}
+
+	mc.metricDescsLock.Lock()
+	defer mc.metricDescsLock.Unlock()
+
+	return mc.addMetricDesc(mt)
+}
+
+// keep counters of ignored values for sensor configs still present after reload
+func keepIgnoreCounts(oldCfg *ExporterConfig, newCfg *ExporterConfig) {
+	ignoreLock.Lock()
+	defer ignoreLock.Unlock()
+
+	for _, newSc := range newCfg.SensorConfigs {
+		for _, oldSc := range oldCfg.SensorConfigs {
+			if sameIdFields(oldSc, newSc) {
+				newSc.IgnoreCount = oldSc.IgnoreCount
+				newSc.ignoredSeen = oldSc.ignoredSeen
+				break
+			}
+		}
+	}
+}
+
+func sameIdFields(sc1 *SensorConfig, sc2 *SensorConfig) bool {
+	for i := range sc1.idFields {
+		if sc1.idFields[i] != sc2.idFields[i] {
+			return false
+		}
+	}
 
-		metricDescs[mt] = prometheus.NewDesc("sensor_measurement_"+mDetails.MetricName, mDetails.MetricHelp, metricLabels, nil)
+	return true
+}
 
-		var vt prometheus.ValueType
+func (mc *metricsConfig) collectDecoderStats(ch chan<- prometheus.Metric, sd sensors.SensorDevice, stats *sensors.DecoderStats) {
+	devLabels := []string{sd.DeviceType(), sd.DeviceId(), sd.DeviceVendor(), sd.DeviceName()}
+
+	for t, v := range stats.Frames {
+		sendMetric(ch, mc.framesDesc, prometheus.CounterValue, v, append(devLabels[:4:4], t))
+	}
 
-		if mDetails.MetricValue == sensors.COUNTER {
-			vt = prometheus.CounterValue
-		} else if mDetails.MetricValue == sensors.GAUGE {
-			vt = prometheus.GaugeValue
-		} else {
-			vt = prometheus.UntypedValue
+	for protocol, dc := range stats.Decoders {
+		for result, v := range dc.Counts {
+			sendMetric(ch, mc.decoderDesc, prometheus.CounterValue, v, append(devLabels[:4:4], protocol, dc.Name, result))
 		}
+	}
+}
+
+// reload config on POST request, like prometheus does
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		metricTypes[mt] = vt
+	err := ReloadConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
 	}
 }
 
@@ -200,9 +535,12 @@ func RegisterCollectorAndServeMetrics(sds []sensors.SensorDevice, addr string) {
 	sensorsCol := &SensorCollector{sensorDevices: sds}
 
 	prometheus.MustRegister(sensorsCol)
+	prometheus.MustRegister(reloadSuccess, reloadTimestamp)
 
 	// now start http server and serve metrics
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/-/reload", handleReload)
+	http.HandleFunc("/sensors", sensorsHandler(sds))
 	log.Infof("Exporter started - metrics available at http://%s/metrics", addr)
 
 	log.Fatal(http.ListenAndServe(addr, nil))
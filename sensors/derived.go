@@ -0,0 +1,79 @@
+package sensors
+
+/* measurements derived from the values reported by a sensor, e.g. dew point
+ * from temperature and humidity
+ */
+
+import (
+	"math"
+)
+
+// Magnus formula constants (Sonntag 1990) for saturation vapour pressure over water
+const magnusA = 17.62
+const magnusB = 243.12 // C
+const magnusE0 = 6.112 // hPa
+
+func DEW_POINT(tempC float64, humidity float64) float64 {
+	g := math.Log(humidity/100) + magnusA*tempC/(magnusB+tempC)
+	return magnusB * g / (magnusA - g)
+}
+
+func ABSOLUTE_HUMIDITY(tempC float64, humidity float64) float64 {
+	// vapour pressure in hPa
+	e := humidity / 100 * magnusE0 * math.Exp(magnusA*tempC/(magnusB+tempC))
+	return 216.7 * e / (273.15 + tempC)
+}
+
+// heat index using the algorithm of the NOAA (https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml)
+func HEAT_INDEX(tempC float64, humidity float64) float64 {
+	t := tempC*9/5 + 32
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity -
+			0.22475541*t*humidity - 0.00683783*t*t -
+			0.05481717*humidity*humidity + 0.00122874*t*t*humidity +
+			0.00085282*t*humidity*humidity - 0.00000199*t*t*humidity*humidity
+
+		if humidity < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if humidity > 85 && t >= 80 && t <= 87 {
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return F_2_C(hi)
+}
+
+// wind chill as used by Environment Canada and the NWS, only defined for temperatures
+// up to 10 C and wind above 4.8 km/h, otherwise the temperature is returned
+func WIND_CHILL(tempC float64, windM_S float64) float64 {
+	v := windM_S * 3.6
+	if tempC > 10 || v <= 4.8 {
+		return tempC
+	}
+
+	vp := math.Pow(v, 0.16)
+	return 13.12 + 0.6215*tempC - 11.37*vp + 0.3965*tempC*vp
+}
+
+// calculate derived measurements for which all needed values are available
+func DeriveMeasurements(values map[MeasurementType]float64) map[MeasurementType]float64 {
+	derived := make(map[MeasurementType]float64)
+
+	temp, hasTemp := values[TEMPERATURE_C]
+	humidity, hasHumidity := values[HUMIDITY_PERCENT]
+	wind, hasWind := values[WIND_AVG_M_S]
+
+	if hasTemp && hasHumidity && humidity > 0 {
+		derived[DEW_POINT_C] = DEW_POINT(temp, humidity)
+		derived[ABSOLUTE_HUMIDITY_G_M3] = ABSOLUTE_HUMIDITY(temp, humidity)
+		derived[HEAT_INDEX_C] = HEAT_INDEX(temp, humidity)
+	}
+
+	if hasTemp && hasWind {
+		derived[WIND_CHILL_C] = WIND_CHILL(temp, wind)
+	}
+
+	return derived
+}
@@ -1,5 +1,11 @@
 package sensors
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
 /* define generic interface to be implemented by each sensor device
  */
 type SensorDevice interface {
@@ -8,17 +14,48 @@ type SensorDevice interface {
 	DeviceVendor() string
 	DeviceName() string
 	GetMeasurements() []Measurement
+	GetSensors() []SensorInfo
+	GetState() *DeviceState
+}
+
+// device specific config, each device decodes the keys it supports
+type DeviceConfig map[string]json.RawMessage
+
+// decode value of key into v, v is unchanged if key is not set
+func (cfg *DeviceConfig) Get(key string, v interface{}) error {
+	if cfg == nil {
+		return nil
+	}
+
+	data, ok := (*cfg)[key]
+	if !ok {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+
+	return nil
 }
 
-type DeviceConfig map[string]string
+// keys supported by all devices: device_id overrides the id reported by the device, to tell
+// multiple devices of the same type apart
+var CommonConfigKeys = []string{"device_id"}
 
 type SupportedDevice struct {
-	Description       string
-	InitFlagsFunction func()
-	InitFunction      func(*DeviceConfig) (SensorDevice, error)
+	Description        string
+	InitFlagsFunction  func()
+	InitFunction       func(*DeviceConfig, *DeviceState) (SensorDevice, error) // state (if any) is restored before collecting starts
+	ConfigKeys         []string                                                // keys supported in DeviceConfig
+	InitConfigFunction func(*DeviceConfig) ([]string, error)                   // validate DeviceConfig without side effects, returns names of metrics defined in it (prefix* for metrics created at runtime)
 }
 
 var SupportedSensorDevices = map[string]*SupportedDevice{
-	"usb_zytemp": {"USB CO2 sensor: Holtek Semiconductor, Inc. USB-zyTemp", InitFlags_zytemp, InitSensor_zytemp},
-	"rtl_433":    {"Generic wrapper using rtl_433 to collect measurements", InitFlags_rtl433, InitSensor_rtl433},
+	"usb_zytemp": {"USB CO2 sensor: Holtek Semiconductor, Inc. USB-zyTemp", InitFlags_zytemp, InitSensor_zytemp, nil, nil},
+	"rtl_433":    {"Generic wrapper using rtl_433 to collect measurements", InitFlags_rtl433, InitSensor_rtl433, rtl433ConfigKeys, InitConfig_rtl433},
 }
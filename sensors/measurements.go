@@ -1,5 +1,11 @@
 package sensors
 
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
 /* define supported measurement types
  */
 type MeasurementType int
@@ -10,26 +16,61 @@ const (
 	HUMIDITY_PERCENT
 	CO2_PPM
 
-	// additional measurements from rtl 433 - is there a complete list
+	// additional measurements from rtl 433 - see https://triq.org/rtl_433/DATA_FORMAT.html
 	BATTERY
 	BATTERY_OK
+	BATTERY_MV
 
 	POWER_W
+	ENERGY_KWH
+	CURRENT_A
+	VOLTAGE_V
 
-	PREASURE_HPA
+	PRESSURE_HPA
 
 	RAIN_RATE_MM_H
 	RAIN_MM
 
 	UV_INDEX
+	LIGHT_LUX
 
 	WIND_AVG_M_S
 	WIND_MAX_M_S
 	WIND_DIR_DEG
 
+	MOISTURE_PERCENT
+	DEPTH_CM
+
+	PM2_5_UG_M3
+	PM10_UG_M3
+
+	STRIKE_COUNT
+	STORM_DIST_KM
+	LIGHTNING_ACTIVE
+	LAST_STRIKE_TIMESTAMP
+
+	// signal quality reported by rtl_433 with -M level
+	RSSI_DB
+	SNR_DB
+	NOISE_DB
+	FREQUENCY_MHZ
+
+	// reception of sensor messages
+	EXPECTED_INTERVAL_SECONDS
+	RECEPTION_RATIO
+
+	// measurements derived from others
+	DEW_POINT_C
+	ABSOLUTE_HUMIDITY_G_M3
+	HEAT_INDEX_C
+	WIND_CHILL_C
+
 	// couter types
 	VALUES_COUNTER
 	IGNORED_COUNTER
+	PACKETS_COUNTER
+	DUPLICATES_COUNTER
+	MISSED_COUNTER
 
 	// types for error counters
 	ERRORS_CONNECT
@@ -40,8 +81,10 @@ const (
 type Measurement struct {
 	Type        MeasurementType
 	Value       float64
-	SensorModel string // model of sensor to use as label - in case multiple sensors report the same measurement
-	SensorId    string // id of sensor to use as label - in case multiple sensors report the same measurement
+	SensorModel string    // model of sensor to use as label - in case multiple sensors report the same measurement
+	SensorId    string    // id of sensor to use as label - in case multiple sensors report the same measurement
+	Timestamp   time.Time // time the value was received, zero for values not received from a sensor (e.g. counters)
+	SensorStats bool      // statistics of the sensor (e.g. packets received), not a value received from it
 }
 
 /* now define for each MeasurementType details to be used for creating a prometheus metric for it
@@ -59,6 +102,9 @@ type MeasurementTypeDetails struct {
 	MetricValue ValueType
 }
 
+// types can be registered while collecting, so access needs to be locked
+var mt_lock sync.RWMutex
+
 // use map instead of array to make definition easier to read and avoid ordering issues
 var mt_details = map[MeasurementType]MeasurementTypeDetails{
 	TEMPERATURE_C:    {"temperature_c", "temperature in C", GAUGE},
@@ -67,28 +113,62 @@ var mt_details = map[MeasurementType]MeasurementTypeDetails{
 
 	BATTERY:    {"battery", "battery state", GAUGE},
 	BATTERY_OK: {"battery_ok", "battery OK", GAUGE},
+	BATTERY_MV: {"battery_mv", "battery voltage in mV", GAUGE},
 
-	POWER_W: {"power_w", "power in W", GAUGE},
+	POWER_W:    {"power_w", "power in W", GAUGE},
+	ENERGY_KWH: {"energy_kwh", "energy in kWh (total)", COUNTER},
+	CURRENT_A:  {"current_a", "current in A", GAUGE},
+	VOLTAGE_V:  {"voltage_v", "voltage in V", GAUGE},
 
-	PREASURE_HPA: {"preasure_hpa", "preasure in hPa", GAUGE},
+	PRESSURE_HPA: {"pressure_hpa", "pressure in hPa", GAUGE},
 
 	RAIN_RATE_MM_H: {"rain_rate_mm_h", "rain rate in mm/H", GAUGE},
-	RAIN_MM:        {"rain_mm", "rain in mm", GAUGE},
+	RAIN_MM:        {"rain_mm", "rain in mm (total)", COUNTER},
 
-	UV_INDEX: {"uv_index", "UV index", GAUGE},
+	UV_INDEX:  {"uv_index", "UV index", GAUGE},
+	LIGHT_LUX: {"light_lux", "light in lux", GAUGE},
 
 	WIND_AVG_M_S: {"wind_avg_m_s", "wind average in m/s", GAUGE},
 	WIND_MAX_M_S: {"wind_max_m_s", "wind max in m/s", GAUGE},
 	WIND_DIR_DEG: {"wind_dir_deg", "wind direction in degree", GAUGE},
 
-	VALUES_COUNTER:  {"values_counter", "values received from sensor", COUNTER},
-	IGNORED_COUNTER: {"ignored_counter", "ignored values from sensor", COUNTER},
-	ERRORS_CONNECT:  {"errors_connect_counter", "errors connecting to sensor", COUNTER},
-	ERRORS_IO:       {"errors_io_counter", "errors receiving data from sensor", COUNTER},
-	ERRORS_PARSE:    {"errors_parse_counter", "errors parsing data from sensor", COUNTER},
+	MOISTURE_PERCENT: {"moisture_percent", "moisture in %", GAUGE},
+	DEPTH_CM:         {"depth_cm", "depth in cm", GAUGE},
+
+	PM2_5_UG_M3: {"pm2_5_ug_m3", "PM2.5 particulate matter in ug/m³", GAUGE},
+	PM10_UG_M3:  {"pm10_ug_m3", "PM10 particulate matter in ug/m³", GAUGE},
+
+	STRIKE_COUNT:          {"strike_counter", "lightning strikes detected", COUNTER},
+	STORM_DIST_KM:         {"storm_dist_km", "distance to storm in km", GAUGE},
+	LIGHTNING_ACTIVE:      {"lightning_active", "lightning detector reports active storm", GAUGE},
+	LAST_STRIKE_TIMESTAMP: {"last_strike_timestamp_seconds", "time the last lightning strike was detected", GAUGE},
+
+	RSSI_DB:       {"rssi_db", "signal strength of last message in dB", GAUGE},
+	SNR_DB:        {"snr_db", "signal to noise ratio of last message in dB", GAUGE},
+	NOISE_DB:      {"noise_db", "noise level of last message in dB", GAUGE},
+	FREQUENCY_MHZ: {"frequency_mhz", "frequency last message was received on in MHz", GAUGE},
+
+	EXPECTED_INTERVAL_SECONDS: {"expected_interval_seconds", "expected interval between messages of sensor (configured or learned)", GAUGE},
+	RECEPTION_RATIO:           {"reception_ratio", "messages received of the ones expected", GAUGE},
+
+	DEW_POINT_C:            {"dew_point_c", "dew point in C (derived from temperature and humidity)", GAUGE},
+	ABSOLUTE_HUMIDITY_G_M3: {"absolute_humidity_g_m3", "absolute humidity in g/m³ (derived from temperature and humidity)", GAUGE},
+	HEAT_INDEX_C:           {"heat_index_c", "heat index (apparent temperature) in C (derived from temperature and humidity)", GAUGE},
+	WIND_CHILL_C:           {"wind_chill_c", "wind chill in C (derived from temperature and wind)", GAUGE},
+
+	VALUES_COUNTER:     {"values_counter", "values received from sensor", COUNTER},
+	IGNORED_COUNTER:    {"ignored_counter", "ignored values from sensor", COUNTER},
+	PACKETS_COUNTER:    {"packets_counter", "packets received from sensor, including duplicates", COUNTER},
+	DUPLICATES_COUNTER: {"duplicate_packets_counter", "repeated packets from sensor dropped as duplicates", COUNTER},
+	MISSED_COUNTER:     {"missed_transmissions_counter", "messages of sensor expected but not received", COUNTER},
+	ERRORS_CONNECT:     {"errors_connect_counter", "errors connecting to sensor", COUNTER},
+	ERRORS_IO:          {"errors_io_counter", "errors receiving data from sensor", COUNTER},
+	ERRORS_PARSE:       {"errors_parse_counter", "errors parsing data from sensor", COUNTER},
 }
 
 func GetAllMeasurementTypes() []MeasurementType {
+	mt_lock.RLock()
+	defer mt_lock.RUnlock()
 
 	keys := make([]MeasurementType, 0, len(mt_details))
 	for k := range mt_details {
@@ -99,5 +179,35 @@ func GetAllMeasurementTypes() []MeasurementType {
 }
 
 func GetMeasurementTypeDetails(m_type MeasurementType) MeasurementTypeDetails {
+	mt_lock.RLock()
+	defer mt_lock.RUnlock()
+
 	return mt_details[m_type]
 }
+
+// register additional measurement type, e.g. defined in config, an existing type with
+// the same metric name is returned if the details match
+func RegisterMeasurementType(details MeasurementTypeDetails) (MeasurementType, error) {
+	mt_lock.Lock()
+	defer mt_lock.Unlock()
+
+	next := MeasurementType(0)
+
+	for mt, d := range mt_details {
+		if d.MetricName == details.MetricName {
+			if d != details {
+				return mt, fmt.Errorf("measurement %s already defined as: %s", d.MetricName, d.MetricHelp)
+			}
+
+			return mt, nil
+		}
+
+		if mt >= next {
+			next = mt + 1
+		}
+	}
+
+	mt_details[next] = details
+
+	return next, nil
+}
@@ -15,10 +15,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -42,30 +42,106 @@ type rtl433 struct {
 	stderrPipe   io.ReadCloser
 	stderrReader *bufio.Reader
 
-	maxMeaurementsPerSensor int
-	sensorMapLock           *sync.Mutex
-	sensordata              map[string]map[string]interface{}
+	store          *MeasurementStore
+	fieldMappings  map[string]*fieldMapping
+	exportUnmapped bool
+	unmappedTypes  map[string]MeasurementType // types registered for unmapped fields
+	strikeCounters map[string]*strikeCounter
+	stats          *rtl433Stats
+	dedupWindow    time.Duration
+	lastMessages   map[string]*lastMessage // by sensor, for detecting duplicates
 }
 
+// last message of a sensor, without the fields differing between repeated transmissions
+type lastMessage struct {
+	content  string
+	received time.Time // first message of the burst
+}
+
+// repeated content within window after the first message of the burst is a duplicate, the window
+// is not extended by the duplicates, so a sensor sending faster than the window is not lost
+func (last *lastMessage) isRepeated(content string, now time.Time, window time.Duration) bool {
+	if last.content == content && now.Sub(last.received) <= window {
+		return true
+	}
+
+	last.content = content
+	last.received = now
+
+	return false
+}
+
+// fields added by rtl_433 for each transmission, not part of the sensor data
+var transmissionFields = map[string]bool{"time": true, "rssi": true, "snr": true, "noise": true, "freq": true, "freq1": true, "freq2": true, "mod": true}
+
+// mapping of a rtl_433 field to a measurement defined in config
+type fieldMapping struct {
+	Metric   string   `json:"metric"`    // metric name without sensor_measurement_ prefix
+	Help     string   `json:"help"`      // metric help
+	Type     string   `json:"type"`      // gauge (default) or counter
+	FromUnit string   `json:"from_unit"` // optional unit the value is converted from, e.g. f, in, km_h
+	Scale    *float64 `json:"scale"`     // optional factor applied after unit conversion
+	Offset   float64  `json:"offset"`    // optional offset applied after scaling
+
+	mType MeasurementType
+	conv  *UnitConverter
+}
+
+func (fm *fieldMapping) convert(v float64) float64 {
+	if fm.conv != nil {
+		v = fm.conv.Convert(v)
+	}
+	if fm.Scale != nil {
+		v *= *fm.Scale
+	}
+
+	return v + fm.Offset
+}
+
+// rules for field names after unit conversion, see https://triq.org/rtl_433/DATA_FORMAT.html
 var valueToMeasurement = map[string]MeasurementType{
 	"temperature_c": TEMPERATURE_C,
 	"humidity":      HUMIDITY_PERCENT,
+	"co2_ppm":       CO2_PPM,
 
 	"battery":    BATTERY,
 	"battery_ok": BATTERY_OK,
+	"battery_mv": BATTERY_MV,
 
-	"power_w": POWER_W,
+	"power_w":    POWER_W,
+	"energy_kwh": ENERGY_KWH,
+	"current_a":  CURRENT_A,
+	"voltage_v":  VOLTAGE_V,
 
-	"preasure_hpa": PREASURE_HPA,
+	"pressure_hpa": PRESSURE_HPA,
 
 	"rain_rate_mm_h": RAIN_RATE_MM_H,
 	"rain_mm":        RAIN_MM,
 
-	"uv": UV_INDEX,
+	"uv":        UV_INDEX,
+	"uvi":       UV_INDEX,
+	"light_lux": LIGHT_LUX,
 
 	"wind_avg_m_s": WIND_AVG_M_S,
 	"wind_max_m_s": WIND_MAX_M_S,
 	"wind_dir_deg": WIND_DIR_DEG,
+
+	"moisture": MOISTURE_PERCENT,
+	"depth_cm": DEPTH_CM,
+
+	"pm2_5_ug_m3": PM2_5_UG_M3,
+	"pm10_ug_m3":  PM10_UG_M3,
+
+	"strike_count":     STRIKE_COUNT,
+	"storm_dist":       STORM_DIST_KM,
+	"storm_dist_km":    STORM_DIST_KM,
+	"lightning_active": LIGHTNING_ACTIVE,
+
+	"rssi":  RSSI_DB,
+	"snr":   SNR_DB,
+	"noise": NOISE_DB,
+	"freq":  FREQUENCY_MHZ,
+	"freq1": FREQUENCY_MHZ, // FSK signals report both frequencies
 }
 
 func (r *rtl433) DeviceType() string {
@@ -85,66 +161,223 @@ func (r *rtl433) DeviceName() string {
 }
 
 func (r *rtl433) GetMeasurements() []Measurement {
-	r.sensorMapLock.Lock()
-	defer r.sensorMapLock.Unlock()
+	mes := r.store.Measurements()
 
-	mes := make([]Measurement, len(r.sensordata)*r.maxMeaurementsPerSensor+4)
-	count := 0
+	mes = append(mes, Measurement{VALUES_COUNTER, r.pkg_counter, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_CONNECT, r.err_connect, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_IO, r.err_io, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_PARSE, r.err_parse, "", "", time.Time{}, false})
 
-	for k, sd := range r.sensordata {
-		for m, v := range sd {
-			if m == "channel" || m == "id" || m == "mic" || m == "model" || m == "time" {
-				// ignore attributes not use as measurements
-				continue
-			}
+	return mes
+}
 
-			// first need to get unit converted, but we don't know yet wheater value is float, so we use a dummy value
-			newM, conv := GetMeasurementConverter(m)
+func (r *rtl433) GetSensors() []SensorInfo {
+	return r.store.Sensors()
+}
 
-			mt, ok := valueToMeasurement[newM]
-			if ok {
-				f, err := asFloat(v)
-				if err != nil {
-					log.Warnf("RTL433: error converting %s (%v) - %s", m, v, err)
-				} else {
-					if conv != nil {
-						f = conv.Convert(f)
-					}
+func (r *rtl433) GetState() *DeviceState {
+	return &DeviceState{
+		Counters: map[string]float64{
+			"values_counter":         r.pkg_counter,
+			"errors_connect_counter": r.err_connect,
+			"errors_io_counter":      r.err_io,
+			"errors_parse_counter":   r.err_parse,
+		},
+		Sensors: r.store.State(),
+	}
+}
 
-					model := asString(sd["model"])
+func (r *rtl433) restoreState(state *DeviceState) {
+	r.pkg_counter += state.Counters["values_counter"]
+	r.err_connect += state.Counters["errors_connect_counter"]
+	r.err_io += state.Counters["errors_io_counter"]
+	r.err_parse += state.Counters["errors_parse_counter"]
 
-					id := ""
-					if sd["channel"] != nil {
-						id = asString(sd["channel"]) + "_"
-					}
+	r.store.RestoreState(state.Sensors)
+}
 
-					id += asString(sd["id"])
+// convert the fields of a rtl_433 message to measurements and store them
+func (r *rtl433) storeMeasurements(data map[string]interface{}) {
+	values := make(map[MeasurementType]float64)
 
-					mes[count] = Measurement{mt, f, model, id}
-					count++
-				}
+	_, isLightning := data["strike_count"]
+
+	for m, v := range data {
+		if m == "channel" || m == "id" || m == "mic" || m == "model" || m == "time" {
+			// ignore attributes not use as measurements
+			continue
+		}
+
+		if isLightning && m == "active" {
+			// generic name, so only used for lightning sensors
+			m = "lightning_active"
+		}
+
+		fm, ok := r.fieldMappings[m]
+		if ok {
+			f, err := asFloat(v)
+			if err != nil {
+				log.Warnf("RTL433: error converting %s (%v) - %s", m, v, err)
 			} else {
-				log.Debugf("RTL433; no rule for measurement %s:%s (%v)", m, newM, v)
+				values[fm.mType] = fm.convert(f)
 			}
+			continue
+		}
 
+		// first need to get unit converted, but we don't know yet wheater value is float, so we use a dummy value
+		newM, conv := GetMeasurementConverter(m)
+
+		mt, ok := valueToMeasurement[newM]
+		if ok {
+			f, err := asFloat(v)
+			if err != nil {
+				log.Warnf("RTL433: error converting %s (%v) - %s", m, v, err)
+			} else {
+				if conv != nil {
+					f = conv.Convert(f)
+				}
+
+				values[mt] = f
+			}
+		} else if r.exportUnmapped {
+			r.addUnmappedValue(values, m, newM, conv, v)
+		} else {
+			log.Debugf("RTL433; no rule for measurement %s:%s (%v)", m, newM, v)
 		}
+	}
+
+	model, id := sensorIds(data)
 
-		delete(r.sensordata, k)
+	if isLightning {
+		r.updateStrikeCount(model, id, values)
 	}
 
-	mes[count] = Measurement{VALUES_COUNTER, r.pkg_counter, "", ""}
-	count++
+	r.store.Set(model, id, values, data)
+}
 
-	mes[count] = Measurement{ERRORS_CONNECT, r.err_connect, "", ""}
-	count++
+func sensorIds(data map[string]interface{}) (string, string) {
+	model := asString(data["model"])
 
-	mes[count] = Measurement{ERRORS_IO, r.err_io, "", ""}
-	count++
+	id := ""
+	if data["channel"] != nil {
+		id = asString(data["channel"]) + "_"
+	}
 
-	mes[count] = Measurement{ERRORS_PARSE, r.err_parse, "", ""}
-	count++
+	id += asString(data["id"])
 
-	return mes[:count]
+	return model, id
+}
+
+// many sensors send each message multiple times in a burst, these are counted as duplicates
+// if the content is unchanged within dedup window after the first one
+func (r *rtl433) isDuplicate(data map[string]interface{}) bool {
+	if r.dedupWindow <= 0 {
+		return false
+	}
+
+	content := make(map[string]interface{}, len(data))
+	for f, v := range data {
+		if !transmissionFields[f] {
+			content[f] = v
+		}
+	}
+
+	// keys of maps are sorted, so same content gives same JSON
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return false
+	}
+
+	model, id := sensorIds(data)
+	key := model + "_" + id
+
+	last, ok := r.lastMessages[key]
+	if !ok {
+		last = &lastMessage{}
+		r.lastMessages[key] = last
+	}
+
+	duplicate := last.isRepeated(string(contentJSON), time.Now(), r.dedupWindow)
+	if duplicate {
+		r.store.Duplicate(model, id)
+	}
+
+	return duplicate
+}
+
+// strike counter of a lightning sensor, resets are handled by the store like for all counters
+type strikeCounter struct {
+	last       float64 // last count reported by sensor
+	lastStrike time.Time
+}
+
+func (r *rtl433) updateStrikeCount(model string, id string, values map[MeasurementType]float64) {
+	count, ok := values[STRIKE_COUNT]
+	if !ok {
+		return
+	}
+
+	key := model + "_" + id
+	sc, ok := r.strikeCounters[key]
+	if !ok {
+		// first message, continue from restored state if available
+		sc = &strikeCounter{last: count}
+		r.strikeCounters[key] = sc
+
+		last, ok := r.store.LastReported(model, id, STRIKE_COUNT)
+		if ok {
+			sc.last = last
+		}
+
+		ts, ok := r.store.LastReported(model, id, LAST_STRIKE_TIMESTAMP)
+		if ok {
+			sc.lastStrike = time.Unix(0, int64(ts*1e9))
+		}
+	}
+
+	if count > sc.last || (count < sc.last && count > 0) {
+		// counted up or reset and counted strikes since
+		sc.lastStrike = time.Now()
+	}
+	sc.last = count
+
+	if !sc.lastStrike.IsZero() {
+		values[LAST_STRIKE_TIMESTAMP] = float64(sc.lastStrike.UnixNano()) / 1e9
+	}
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// prefix of metrics for unmapped fields
+const unmappedPrefix = "rtl433_"
+
+// export numeric fields without rule as sensor_measurement_rtl433_<field>
+func (r *rtl433) addUnmappedValue(values map[MeasurementType]float64, m string, newM string, conv *UnitConverter, v interface{}) {
+	f, err := asFloat(v)
+	if err != nil {
+		log.Debugf("RTL433; ignoring non numeric field %s (%v)", m, v)
+		return
+	}
+
+	if conv != nil {
+		f = conv.Convert(f)
+	}
+
+	mt, ok := r.unmappedTypes[newM]
+	if !ok {
+		name := unmappedPrefix + invalidMetricChars.ReplaceAllString(strings.ToLower(newM), "_")
+
+		mt, err = RegisterMeasurementType(MeasurementTypeDetails{name, "rtl_433 field " + newM + " (unmapped)", GAUGE})
+		if err != nil {
+			log.Warnf("RTL433: can't export unmapped field %s: %s", m, err)
+			return
+		}
+
+		log.Infof("RTL433: exporting unmapped field %s as %s", m, name)
+		r.unmappedTypes[newM] = mt
+	}
+
+	values[mt] = f
 }
 
 func asString(v interface{}) string {
@@ -203,25 +436,26 @@ func (r *rtl433) monitor() {
 				r.err_io++
 			} else {
 				log.Debugf("RTL433: %s", line)
-				r.pkg_counter++
 
 				var data map[string]interface{}
 				err := json.Unmarshal(line, &data)
 				if err != nil {
 					log.Warnf("RTL433: Failed to unmarshal data: %s", err)
+					r.pkg_counter++
 					r.err_parse++
+				} else if isRtl433Meta(data) {
+					r.storeMeta(data)
 				} else {
+					r.pkg_counter++
+
 					key := asString(data["model"]) + "_" + asString(data["channel"]) + "_" + asString(data["id"])
 					log.Debugf("RTL433: Unmarshalled %s: %v", key, data)
 
-					r.sensorMapLock.Lock()
-					r.sensordata[key] = data
-
-					if len(data) > r.maxMeaurementsPerSensor {
-						r.maxMeaurementsPerSensor = len(data)
+					if r.isDuplicate(data) {
+						log.Debugf("RTL433: ignoring duplicate message of %s", key)
+					} else {
+						r.storeMeasurements(data)
 					}
-
-					r.sensorMapLock.Unlock()
 				}
 			}
 		} else {
@@ -274,7 +508,8 @@ func (r *rtl433) run_RTL433(init bool) error {
 
 	log.Debugf("RTL433: runnning: %s", r.rtl433_path)
 
-	args := []string{"-v", "-C", "si", "-F", "json"}
+	// level metadata adds rssi, snr, noise and freq to each message
+	args := []string{"-v", "-C", "si", "-F", "json", "-M", "level"}
 	args = append(args, r.additionalArgs...)
 
 	log.Debugf("RTL433: starting %s with args: %v", r.rtl433_path, args)
@@ -366,17 +601,12 @@ func (r *rtl433) run_RTL433(init bool) error {
 			}
 
 			if strings.HasPrefix(line, "Reading samples") {
-				log.Warnf("RTL433: rtl_433 starts reading - but not all info parsed", m)
+				log.Warnf("RTL433: rtl_433 starts reading - but not all info parsed: %v", m)
 				break
 			}
 		}
 	}
 
-	// we're ready so create map for storing sensor data
-	r.sensorMapLock = &sync.Mutex{}
-	r.sensordata = make(map[string]map[string]interface{})
-	r.maxMeaurementsPerSensor = 4 // a wild guess
-
 	// we got the device info, the rest of stderr goes to debug
 	go r.readStderr()
 
@@ -387,23 +617,207 @@ func InitFlags_rtl433() {
 	flag.StringVar(&FlagRtl433Path, "rtl433-path", "rtl_433", "Path to rtl_433 binary.")
 }
 
-func InitSensor_rtl433(cfg *DeviceConfig) (SensorDevice, error) {
+// read field mappings from config, mappings to existing metrics use their measurement types,
+// types for new metrics are only registered if requested, so validating has no side effects
+func getFieldMappings(cfg *DeviceConfig, register bool) (map[string]*fieldMapping, error) {
+	var mappings map[string]*fieldMapping
+	err := cfg.Get("field_mappings", &mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	newTypes := make(map[string]ValueType)
+
+	for field, fm := range mappings {
+		if fm.Metric == "" {
+			return nil, fmt.Errorf("field_mappings: no metric set for %s", field)
+		}
+		if !model.IsValidMetricName(model.LabelValue("sensor_measurement_" + fm.Metric)) {
+			return nil, fmt.Errorf("field_mappings: invalid metric name %s for %s", fm.Metric, field)
+		}
+
+		vt := GAUGE
+		if fm.Type == "counter" {
+			vt = COUNTER
+		} else if fm.Type != "" && fm.Type != "gauge" {
+			return nil, fmt.Errorf("field_mappings: unknown type %s for %s", fm.Type, field)
+		}
+
+		if fm.FromUnit != "" {
+			for _, conv := range convTable {
+				if conv.SrcType == strings.ToLower(fm.FromUnit) {
+					fm.conv = conv
+				}
+			}
+
+			if fm.conv == nil {
+				return nil, fmt.Errorf("field_mappings: unknown unit %s for %s", fm.FromUnit, field)
+			}
+		}
+
+		mt, ok := GetMeasurementTypeByName(fm.Metric)
+		if ok {
+			if GetMeasurementTypeDetails(mt).MetricValue != vt {
+				return nil, fmt.Errorf("field_mappings: type of %s for %s differs from existing metric", fm.Metric, field)
+			}
+
+			fm.mType = mt
+			continue
+		}
+
+		prevVt, ok := newTypes[fm.Metric]
+		if ok && prevVt != vt {
+			return nil, fmt.Errorf("field_mappings: different types for %s", fm.Metric)
+		}
+		newTypes[fm.Metric] = vt
+
+		if !register {
+			continue
+		}
+
+		help := fm.Help
+		if help == "" {
+			help = "rtl_433 field " + field
+		}
 
-	var addArgs []string
-	if cfg != nil && (*cfg)["additional_args"] != "" {
-		addArgs = strings.Split((*cfg)["additional_args"], " ")
+		fm.mType, err = RegisterMeasurementType(MeasurementTypeDetails{fm.Metric, help, vt})
+		if err != nil {
+			return nil, fmt.Errorf("field_mappings: %s", err)
+		}
+	}
+
+	return mappings, nil
+}
+
+// default time repeated messages are detected as duplicates
+const defaultDedupWindow = 2 * time.Second
+
+func getDedupWindow(cfg *DeviceConfig) (time.Duration, error) {
+	seconds := defaultDedupWindow.Seconds()
+	err := cfg.Get("dedup_window", &seconds)
+	if err != nil {
+		return 0, err
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("invalid dedup_window %v", seconds)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// intervals between messages in seconds by model, e.g. {"Ambientweather-F007TH": 53}
+func getExpectedIntervals(cfg *DeviceConfig) (map[string]time.Duration, error) {
+	var seconds map[string]float64
+	err := cfg.Get("expected_intervals", &seconds)
+	if err != nil {
+		return nil, err
+	}
+
+	intervals := make(map[string]time.Duration, len(seconds))
+	for model, s := range seconds {
+		if s <= 0 {
+			return nil, fmt.Errorf("expected_intervals: invalid interval %v for %s", s, model)
+		}
+		intervals[model] = time.Duration(s * float64(time.Second))
+	}
+
+	return intervals, nil
+}
+
+func InitConfig_rtl433(cfg *DeviceConfig) ([]string, error) {
+	mappings, err := getFieldMappings(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = getRtl433Args(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = getDedupWindow(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = getExpectedIntervals(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var exportUnmapped bool
+	err = cfg.Get("export_unmapped", &exportUnmapped)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricNames []string
+	for _, fm := range mappings {
+		metricNames = append(metricNames, fm.Metric)
+	}
+	if exportUnmapped {
+		metricNames = append(metricNames, unmappedPrefix+"*")
+	}
+
+	return metricNames, nil
+}
+
+func InitSensor_rtl433(cfg *DeviceConfig, state *DeviceState) (SensorDevice, error) {
+
+	addArgs, err := getRtl433Args(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldMappings, err := getFieldMappings(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var exportUnmapped bool
+	err = cfg.Get("export_unmapped", &exportUnmapped)
+	if err != nil {
+		return nil, err
+	}
+
+	var deviceId string
+	err = cfg.Get("device_id", &deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	dedupWindow, err := getDedupWindow(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedIntervals, err := getExpectedIntervals(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// check that device exists
-	r := &rtl433{rtl433_path: FlagRtl433Path, additionalArgs: addArgs, deviceId: "<unknown>", manufacturer: "<unknown>", deviceName: "<unknown>"}
+	r := &rtl433{rtl433_path: FlagRtl433Path, additionalArgs: addArgs, deviceId: "<unknown>", manufacturer: "<unknown>", deviceName: "<unknown>", store: NewMeasurementStore(), fieldMappings: fieldMappings,
+		exportUnmapped: exportUnmapped, unmappedTypes: make(map[string]MeasurementType),
+		strikeCounters: make(map[string]*strikeCounter), stats: newRtl433Stats(),
+		dedupWindow: dedupWindow, lastMessages: make(map[string]*lastMessage)}
+	r.store.SetExpectedIntervals(expectedIntervals)
 
-	err := r.run_RTL433(true)
+	err = r.run_RTL433(true)
 
 	if err != nil {
 		log.Errorf("RTL433: Error dedecting RLT_433 sensor: %s", err)
 		return nil, err
 	}
 
+	if deviceId != "" {
+		r.deviceId = deviceId
+	}
+
+	if state != nil {
+		r.restoreState(state)
+	}
+
 	go r.monitor()
 
 	return r, nil
@@ -0,0 +1,202 @@
+package sensors
+
+/* typed rtl_433 options from the device config, converted to arguments
+ * see https://triq.org/rtl_433/OPERATION.html
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rtl433ConfigKeys = []string{"device", "frequencies", "hop_interval", "sample_rate", "gain", "ppm_error",
+	"protocols", "disabled_protocols", "flex_decoders", "stats_interval", "additional_args", "field_mappings", "export_unmapped", "dedup_window",
+	"expected_intervals"}
+
+// frequency or sample rate like 433.92M, 250k or 868300000
+var frequencyRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kMG]?$`)
+
+func getRtl433Args(cfg *DeviceConfig) ([]string, error) {
+	var args []string
+
+	var device string
+	err := cfg.Get("device", &device)
+	if err != nil {
+		return nil, err
+	}
+	if device != "" {
+		// index, :serial or SoapySDR device query
+		args = append(args, "-d", device)
+	}
+
+	var frequencies []string
+	err = cfg.Get("frequencies", &frequencies)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range frequencies {
+		if !frequencyRe.MatchString(f) {
+			return nil, fmt.Errorf("invalid frequency '%s'", f)
+		}
+		args = append(args, "-f", f)
+	}
+
+	var hopInterval int
+	err = cfg.Get("hop_interval", &hopInterval)
+	if err != nil {
+		return nil, err
+	}
+	if hopInterval < 0 {
+		return nil, fmt.Errorf("invalid hop_interval %d", hopInterval)
+	} else if hopInterval > 0 {
+		if len(frequencies) < 2 {
+			return nil, fmt.Errorf("hop_interval requires at least 2 frequencies")
+		}
+		args = append(args, "-H", strconv.Itoa(hopInterval))
+	}
+
+	var sampleRate string
+	err = cfg.Get("sample_rate", &sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	if sampleRate != "" {
+		if !frequencyRe.MatchString(sampleRate) {
+			return nil, fmt.Errorf("invalid sample_rate '%s'", sampleRate)
+		}
+		args = append(args, "-s", sampleRate)
+	}
+
+	var gain string
+	err = cfg.Get("gain", &gain)
+	if err != nil {
+		return nil, err
+	}
+	if gain != "" {
+		// dB for rtl-sdr (0 is auto), or list of gains for SoapySDR, e.g. LNA=20,TIA=8
+		args = append(args, "-g", gain)
+	}
+
+	var ppmError int
+	err = cfg.Get("ppm_error", &ppmError)
+	if err != nil {
+		return nil, err
+	}
+	if ppmError != 0 {
+		args = append(args, "-p", strconv.Itoa(ppmError))
+	}
+
+	var protocols []int
+	err = cfg.Get("protocols", &protocols)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range protocols {
+		if p <= 0 {
+			return nil, fmt.Errorf("invalid protocol %d", p)
+		}
+		args = append(args, "-R", strconv.Itoa(p))
+	}
+
+	var disabledProtocols []int
+	err = cfg.Get("disabled_protocols", &disabledProtocols)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range disabledProtocols {
+		if p <= 0 {
+			return nil, fmt.Errorf("invalid protocol %d in disabled_protocols", p)
+		}
+		args = append(args, "-R", strconv.Itoa(-p))
+	}
+
+	var flexDecoders []string
+	err = cfg.Get("flex_decoders", &flexDecoders)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range flexDecoders {
+		if strings.TrimSpace(x) == "" {
+			return nil, fmt.Errorf("empty flex decoder")
+		}
+		args = append(args, "-X", x)
+	}
+
+	var statsInterval int
+	err = cfg.Get("stats_interval", &statsInterval)
+	if err != nil {
+		return nil, err
+	}
+	if statsInterval < 0 {
+		return nil, fmt.Errorf("invalid stats_interval %d", statsInterval)
+	} else if statsInterval > 0 {
+		// level 2: stats of all decoders with events, so decoders decoding only noise are reported too
+		args = append(args, "-M", "stats:2:"+strconv.Itoa(statsInterval))
+	}
+
+	var addArgs string
+	err = cfg.Get("additional_args", &addArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := splitArgs(addArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid additional_args: %s", err)
+	}
+
+	return append(args, raw...), nil
+}
+
+// split arguments like a shell: whitespace separates arguments, unless quoted with ' or "
+// or escaped with \ (not within '), quotes are removed
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	quote := rune(0)
+	escaped := false
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing quote %c", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,94 @@
+package sensors
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in      string
+		args    []string
+		invalid bool
+	}{
+		{"", nil, false},
+		{"  \t\n ", nil, false},
+		{"-d 0 -f 433.92M", []string{"-d", "0", "-f", "433.92M"}, false},
+		{"  -d   0  ", []string{"-d", "0"}, false},
+		{`-X "n=name,m=OOK_PWM"`, []string{"-X", "n=name,m=OOK_PWM"}, false},
+		{`-X 'a b' "c d"`, []string{"-X", "a b", "c d"}, false},
+		{`a"b c"d`, []string{"ab cd"}, false},
+		{`"" ''`, []string{"", ""}, false},
+		{`a\ b`, []string{"a b"}, false},
+		{`"a\"b"`, []string{`a"b`}, false},
+		{`'a\b'`, []string{`a\b`}, false},
+		{`\\`, []string{`\`}, false},
+		{`a\`, nil, true},
+		{`"a b`, nil, true},
+		{`'a b`, nil, true},
+	}
+
+	for _, test := range tests {
+		args, err := splitArgs(test.in)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("splitArgs(%q): expected error, got %q", test.in, args)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("splitArgs(%q): unexpected error: %s", test.in, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs(%q) = %q, expected %q", test.in, args, test.args)
+		}
+	}
+}
+
+func TestGetRtl433Args(t *testing.T) {
+	tests := []struct {
+		cfg     string
+		args    []string
+		invalid bool
+	}{
+		{`{}`, nil, false},
+		{`{"device": ":00000001", "frequencies": ["433.92M", "868.3M"], "hop_interval": 600}`,
+			[]string{"-d", ":00000001", "-f", "433.92M", "-f", "868.3M", "-H", "600"}, false},
+		{`{"sample_rate": "1024k", "gain": "LNA=20,TIA=8", "ppm_error": -3}`,
+			[]string{"-s", "1024k", "-g", "LNA=20,TIA=8", "-p", "-3"}, false},
+		{`{"protocols": [19, 20], "disabled_protocols": [40]}`, []string{"-R", "19", "-R", "20", "-R", "-40"}, false},
+		{`{"stats_interval": 60, "additional_args": "-Y 'minlevel=-20'"}`, []string{"-M", "stats:2:60", "-Y", "minlevel=-20"}, false},
+		{`{"frequencies": ["433,92M"]}`, nil, true},
+		{`{"frequencies": ["433.92M"], "hop_interval": 600}`, nil, true},
+		{`{"hop_interval": -1}`, nil, true},
+		{`{"protocols": [0]}`, nil, true},
+		{`{"disabled_protocols": [-1]}`, nil, true},
+		{`{"flex_decoders": [" "]}`, nil, true},
+		{`{"stats_interval": -1}`, nil, true},
+		{`{"additional_args": "'-d"}`, nil, true},
+		{`{"ppm_error": "3"}`, nil, true},
+	}
+
+	for _, test := range tests {
+		var cfg DeviceConfig
+		err := json.Unmarshal([]byte(test.cfg), &cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", test.cfg, err)
+		}
+
+		args, err := getRtl433Args(&cfg)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("getRtl433Args(%s): expected error, got %q", test.cfg, args)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("getRtl433Args(%s): unexpected error: %s", test.cfg, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("getRtl433Args(%s) = %q, expected %q", test.cfg, args, test.args)
+		}
+	}
+}
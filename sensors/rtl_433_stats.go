@@ -0,0 +1,151 @@
+package sensors
+
+/* decoder statistics reported by rtl_433 with -M stats, see
+ * https://triq.org/rtl_433/OPERATION.html#meta-data
+ */
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// counts of a decoder by result, e.g. events, ok, messages, fail_mic
+type DecoderCounts struct {
+	Name   string
+	Counts map[string]float64
+}
+
+type DecoderStats struct {
+	Frames   map[string]float64        // frames received by type, e.g. count, fsk, events
+	Decoders map[string]*DecoderCounts // by protocol number
+}
+
+// implemented by devices reporting statistics of their decoders
+type DecoderStatsProvider interface {
+	GetDecoderStats() *DecoderStats
+}
+
+// counters summed up from the stats reports
+type rtl433Stats struct {
+	lock     sync.Mutex
+	since    string             // start of the counts in the last report
+	last     map[string]float64 // counts of last report by key, to add only the increase
+	frames   map[string]float64 // by type
+	decoders map[string]*DecoderCounts
+}
+
+func newRtl433Stats() *rtl433Stats {
+	return &rtl433Stats{last: make(map[string]float64), frames: make(map[string]float64), decoders: make(map[string]*DecoderCounts)}
+}
+
+// messages without model are meta data, e.g. stats reports
+func isRtl433Meta(data map[string]interface{}) bool {
+	_, ok := data["model"]
+	return !ok
+}
+
+func (r *rtl433) storeMeta(data map[string]interface{}) {
+	_, hasStats := data["stats"]
+	_, hasFrames := data["frames"]
+	if !hasStats && !hasFrames {
+		log.Debugf("RTL433: ignoring meta data %v", data)
+		return
+	}
+
+	r.stats.update(data)
+}
+
+// add counts from a stats report, counts are either since a new start time (rtl_433 resets
+// them after reporting) or since the same start as the last report
+func (st *rtl433Stats) update(data map[string]interface{}) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	since := asString(data["since"])
+	if since != st.since {
+		st.last = make(map[string]float64)
+		st.since = since
+	}
+
+	frames, ok := data["frames"].(map[string]interface{})
+	if ok {
+		for t, v := range frames {
+			f, err := asFloat(v)
+			if err != nil {
+				log.Debugf("RTL433: ignoring stats frames %s (%v)", t, v)
+				continue
+			}
+
+			st.frames[t] += st.increase("frames_"+t, f)
+		}
+	}
+
+	decoders, ok := data["stats"].([]interface{})
+	if !ok {
+		return
+	}
+
+	for _, d := range decoders {
+		dec, ok := d.(map[string]interface{})
+		if !ok || dec["device"] == nil {
+			continue
+		}
+
+		protocol := asString(dec["device"])
+		dc, ok := st.decoders[protocol]
+		if !ok {
+			dc = &DecoderCounts{Counts: make(map[string]float64)}
+			st.decoders[protocol] = dc
+		}
+		if dec["name"] != nil {
+			dc.Name = asString(dec["name"])
+		}
+
+		for result, v := range dec {
+			if result == "device" || result == "name" {
+				continue
+			}
+
+			f, err := asFloat(v)
+			if err != nil {
+				log.Debugf("RTL433: ignoring stats %s of protocol %s (%v)", result, protocol, v)
+				continue
+			}
+
+			dc.Counts[result] += st.increase(protocol+"_"+result, f)
+		}
+	}
+}
+
+func (st *rtl433Stats) increase(key string, v float64) float64 {
+	last := st.last[key]
+	st.last[key] = v
+
+	if v < last {
+		// restarted
+		return v
+	}
+
+	return v - last
+}
+
+func (r *rtl433) GetDecoderStats() *DecoderStats {
+	r.stats.lock.Lock()
+	defer r.stats.lock.Unlock()
+
+	ds := &DecoderStats{make(map[string]float64), make(map[string]*DecoderCounts)}
+	for t, v := range r.stats.frames {
+		ds.Frames[t] = v
+	}
+
+	for p, dc := range r.stats.decoders {
+		counts := make(map[string]float64)
+		for result, v := range dc.Counts {
+			counts[result] = v
+		}
+		ds.Decoders[p] = &DecoderCounts{dc.Name, counts}
+	}
+
+	return ds
+}
@@ -0,0 +1,72 @@
+package sensors
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRtl433StatsIncrease(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		increase []float64
+	}{
+		{"first report", []float64{5}, []float64{5}},
+		{"growing", []float64{5, 7, 7, 10}, []float64{5, 2, 0, 3}},
+		{"restarted", []float64{5, 8, 2, 4}, []float64{5, 3, 2, 2}},
+		{"restarted at zero", []float64{5, 0, 1}, []float64{5, 0, 1}},
+	}
+
+	for _, test := range tests {
+		st := newRtl433Stats()
+		for i, v := range test.values {
+			inc := st.increase("frames_count", v)
+			if inc != test.increase[i] {
+				t.Errorf("%s: increase #%d of %v = %v, expected %v", test.name, i, v, inc, test.increase[i])
+			}
+		}
+	}
+}
+
+func TestRtl433StatsUpdate(t *testing.T) {
+	reports := []string{
+		`{"since": "2023-06-01T10:00:00", "frames": {"count": 10, "fsk": 4}, "stats": [{"device": 19, "name": "Nexus", "events": 8, "ok": 6}]}`,
+		// counts since the same start
+		`{"since": "2023-06-01T10:00:00", "frames": {"count": 15, "fsk": 4}, "stats": [{"device": 19, "name": "Nexus", "events": 10, "ok": 7}]}`,
+		// counts reset after reporting
+		`{"since": "2023-06-01T10:10:00", "frames": {"count": 3, "fsk": 1}, "stats": [{"device": 19, "name": "Nexus", "events": 2, "ok": 2}]}`,
+	}
+
+	st := newRtl433Stats()
+	for _, r := range reports {
+		var data map[string]interface{}
+		err := json.Unmarshal([]byte(r), &data)
+		if err != nil {
+			t.Fatalf("%s: %s", r, err)
+		}
+
+		st.update(data)
+	}
+
+	expectedFrames := map[string]float64{"count": 18, "fsk": 5}
+	for f, v := range expectedFrames {
+		if st.frames[f] != v {
+			t.Errorf("frames %s = %v, expected %v", f, st.frames[f], v)
+		}
+	}
+
+	dc := st.decoders["19"]
+	if dc == nil {
+		t.Fatalf("no counts of protocol 19")
+	}
+	if dc.Name != "Nexus" {
+		t.Errorf("name of protocol 19 = %s, expected Nexus", dc.Name)
+	}
+
+	expectedCounts := map[string]float64{"events": 12, "ok": 9}
+	for result, v := range expectedCounts {
+		if dc.Counts[result] != v {
+			t.Errorf("protocol 19 %s = %v, expected %v", result, dc.Counts[result], v)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package sensors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastMessageIsRepeated(t *testing.T) {
+	window := 2 * time.Second
+
+	tests := []struct {
+		name      string
+		contents  []string
+		seconds   []float64 // since first message
+		duplicate []bool
+	}{
+		{"burst", []string{"a", "a", "a"}, []float64{0, 0.5, 1}, []bool{false, true, true}},
+		{"changed content", []string{"a", "b", "a"}, []float64{0, 0.5, 1}, []bool{false, false, false}},
+		{"next message", []string{"a", "a", "a", "a"}, []float64{0, 0.5, 30, 30.5}, []bool{false, true, false, true}},
+		// the window is not extended by the duplicates
+		{"anchored window", []string{"a", "a", "a", "a", "a"}, []float64{0, 1.5, 3, 4, 4.5}, []bool{false, true, false, true, true}},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		last := &lastMessage{}
+		for i, c := range test.contents {
+			now := start.Add(time.Duration(test.seconds[i] * float64(time.Second)))
+			duplicate := last.isRepeated(c, now, window)
+			if duplicate != test.duplicate[i] {
+				t.Errorf("%s: message #%d duplicate = %v, expected %v", test.name, i, duplicate, test.duplicate[i])
+			}
+		}
+	}
+}
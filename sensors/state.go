@@ -0,0 +1,174 @@
+package sensors
+
+/* state of a device to be persisted across restarts, measurements are
+ * referenced by metric name, as the ids of measurement types might change
+ */
+
+import (
+	"time"
+)
+
+type ValueState struct {
+	Value    float64   `json:"value"`
+	Received time.Time `json:"received"`
+}
+
+type CounterState struct {
+	Last   float64 `json:"last"`
+	Offset float64 `json:"offset"`
+}
+
+type SensorState struct {
+	SensorModel string                  `json:"sensor_model"`
+	SensorId    string                  `json:"sensor_id"`
+	FirstSeen   time.Time               `json:"first_seen"`
+	LastSeen    time.Time               `json:"last_seen"`
+	Count       float64                 `json:"count"`
+	Duplicates  float64                 `json:"duplicates"`
+	Missed      float64                 `json:"missed"`
+	Gaps        []float64               `json:"recent_gaps"` // seconds between messages for learning the interval
+	Fields      []string                `json:"fields"`
+	Values      map[string]ValueState   `json:"values"`
+	Counters    map[string]CounterState `json:"counters"`
+}
+
+type DeviceState struct {
+	Counters map[string]float64 `json:"counters"` // counters of the device, e.g. values_counter
+	Sensors  []SensorState      `json:"sensors"`
+}
+
+func GetMeasurementTypeByName(metricName string) (MeasurementType, bool) {
+	mt_lock.RLock()
+	defer mt_lock.RUnlock()
+
+	for mt, d := range mt_details {
+		if d.MetricName == metricName {
+			return mt, true
+		}
+	}
+
+	return 0, false
+}
+
+// get state of all sensors in store
+func (s *MeasurementStore) State() []SensorState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	states := make([]SensorState, 0, len(s.sensors))
+	for _, e := range s.sensors {
+		ss := SensorState{e.model, e.id, e.firstSeen, e.lastSeen, e.count, e.duplicates, e.missed, make([]float64, 0, len(e.recentGaps)), make([]string, 0, len(e.fields)),
+			make(map[string]ValueState), make(map[string]CounterState)}
+
+		for _, g := range e.recentGaps {
+			ss.Gaps = append(ss.Gaps, g.Seconds())
+		}
+
+		for f := range e.fields {
+			ss.Fields = append(ss.Fields, f)
+		}
+
+		for mt, v := range e.values {
+			ss.Values[GetMeasurementTypeDetails(mt).MetricName] = ValueState{v.value, v.received}
+		}
+
+		for mt, cs := range e.counters {
+			ss.Counters[GetMeasurementTypeDetails(mt).MetricName] = CounterState{cs.last, cs.offset}
+		}
+
+		states = append(states, ss)
+	}
+
+	return states
+}
+
+// restore state of sensors, values already received since start are kept and
+// counters are continued from the restored ones
+func (s *MeasurementStore) RestoreState(states []SensorState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, ss := range states {
+		_, seen := s.sensors[ss.SensorModel+"_"+ss.SensorId]
+
+		e := s.entry(ss.SensorModel, ss.SensorId)
+		e.count += ss.Count
+		e.duplicates += ss.Duplicates
+		e.missed += ss.Missed
+		// restored gaps are older than the ones seen since start
+		gaps := make([]time.Duration, 0, len(ss.Gaps)+len(e.recentGaps))
+		for _, g := range ss.Gaps {
+			gaps = append(gaps, time.Duration(g*float64(time.Second)))
+		}
+		gaps = append(gaps, e.recentGaps...)
+		e.recentGaps, e.interval = nil, 0
+		e.learnInterval(gaps...)
+		if !ss.FirstSeen.IsZero() {
+			e.firstSeen = ss.FirstSeen
+		}
+		for _, f := range ss.Fields {
+			e.fields[f] = true
+		}
+
+		if !seen {
+			e.lastSeen = ss.LastSeen
+		}
+
+		// values are merged per field, so restore the ones not received since start
+		for name, vs := range ss.Values {
+			mt, ok := GetMeasurementTypeByName(name)
+			if !ok {
+				continue
+			}
+
+			_, received := e.values[mt]
+			if !received {
+				e.values[mt] = storedValue{vs.Value, vs.Received}
+			}
+		}
+
+		for name, saved := range ss.Counters {
+			mt, ok := GetMeasurementTypeByName(name)
+			if !ok {
+				continue
+			}
+
+			cs, ok := e.counters[mt]
+			if !ok {
+				e.counters[mt] = &counterState{saved.Last, saved.Offset}
+				continue
+			}
+
+			// counter received since start, check whether it was reset in between
+			cs.offset = saved.Offset
+			if cs.last < saved.Last {
+				cs.offset += saved.Last
+			}
+
+			v, ok := e.values[mt]
+			if ok {
+				e.values[mt] = storedValue{cs.offset + cs.last, v.received}
+			}
+		}
+	}
+}
+
+// get value last reported by a sensor, for counters the value before continuing it
+func (s *MeasurementStore) LastReported(model string, id string, mt MeasurementType) (float64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.sensors[model+"_"+id]
+	if !ok {
+		return 0, false
+	}
+
+	cs, ok := e.counters[mt]
+	if ok {
+		return cs.last, true
+	}
+
+	v, ok := e.values[mt]
+
+	return v.value, ok
+}
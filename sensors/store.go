@@ -0,0 +1,284 @@
+package sensors
+
+/* store for the latest measurements of each sensor, written by the device
+ * goroutines and read by the collector without consuming the values, so
+ * multiple scrapers see the same data
+ */
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// time after which values of a sensor not reporting anymore are dropped
+var MeasurementTTL = 5 * time.Minute
+
+// info about a sensor seen by a device
+type SensorInfo struct {
+	SensorModel string
+	SensorId    string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Count       float64                // messages received, without duplicates
+	Duplicates  float64                // repeated messages dropped
+	Fields      []string               // all fields reported by the sensor
+	LastMessage map[string]interface{} // last message as received, if available
+}
+
+type storedValue struct {
+	value    float64
+	received time.Time
+}
+
+// cumulative value reported by a sensor, continued when the sensor resets it
+type counterState struct {
+	last   float64 // last value reported by sensor
+	offset float64 // accumulated values before resets
+}
+
+type sensorEntry struct {
+	model         string
+	id            string
+	firstSeen     time.Time
+	lastSeen      time.Time
+	count         float64
+	duplicates    float64
+	missed        float64
+	interval      time.Duration   // learned interval between messages
+	recentGaps    []time.Duration // last gaps between messages used for learning the interval
+	lastMessageAt time.Time       // time of last message since start, for gaps between messages
+	fields        map[string]bool
+	lastMessage   map[string]interface{}
+	values        map[MeasurementType]storedValue
+	counters      map[MeasurementType]*counterState
+}
+
+type MeasurementStore struct {
+	lock              sync.Mutex
+	sensors           map[string]*sensorEntry
+	expectedIntervals map[string]time.Duration // configured intervals between messages by model
+}
+
+func NewMeasurementStore() *MeasurementStore {
+	return &MeasurementStore{sensors: make(map[string]*sensorEntry)}
+}
+
+func (s *MeasurementStore) entry(model string, id string) *sensorEntry {
+	key := model + "_" + id
+
+	e, ok := s.sensors[key]
+	if !ok {
+		e = &sensorEntry{model: model, id: id, fields: make(map[string]bool),
+			values: make(map[MeasurementType]storedValue), counters: make(map[MeasurementType]*counterState)}
+		s.sensors[key] = e
+	}
+
+	return e
+}
+
+func (e *sensorEntry) received(now time.Time) {
+	if e.firstSeen.IsZero() {
+		e.firstSeen = now
+	}
+	e.lastSeen = now
+	e.count++
+}
+
+// intervals between messages by sensor model, for models not configured the interval is learned
+func (s *MeasurementStore) SetExpectedIntervals(intervals map[string]time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expectedIntervals = intervals
+}
+
+// gaps needed before using the learned interval, and the number of gaps it is learned from
+const (
+	minGapsForInterval = 3
+	maxGapsForInterval = 15
+)
+
+// learn interval as median of the recent gaps, so single short gaps (retransmissions not dropped
+// as duplicates) or long gaps (missed messages) don't change it, gaps shorter than half the
+// interval are ignored
+func (e *sensorEntry) learnInterval(gaps ...time.Duration) {
+	for _, gap := range gaps {
+		if gap <= 0 || gap < e.interval/2 {
+			continue
+		}
+
+		e.recentGaps = append(e.recentGaps, gap)
+		if len(e.recentGaps) > maxGapsForInterval {
+			e.recentGaps = e.recentGaps[len(e.recentGaps)-maxGapsForInterval:]
+		}
+
+		sorted := append([]time.Duration(nil), e.recentGaps...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		e.interval = sorted[len(sorted)/2]
+	}
+}
+
+// count messages missed in the gap since the last message, sensors send in a fixed interval (with
+// some jitter)
+func (e *sensorEntry) trackMessages(now time.Time, configured time.Duration) {
+	defer func() { e.lastMessageAt = now }()
+
+	if e.lastMessageAt.IsZero() {
+		return
+	}
+
+	gap := now.Sub(e.lastMessageAt)
+	e.learnInterval(gap)
+
+	interval := configured
+	if interval == 0 && len(e.recentGaps) >= minGapsForInterval {
+		interval = e.interval
+	}
+	if interval <= 0 {
+		return
+	}
+
+	missed := math.Round(float64(gap)/float64(interval)) - 1
+	if missed > 0 {
+		e.missed += missed
+	}
+}
+
+func (e *sensorEntry) expectedInterval(configured time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	if len(e.recentGaps) >= minGapsForInterval {
+		return e.interval
+	}
+
+	return 0
+}
+
+// merge values of a message into the values of a sensor, sensors sending alternating messages
+// with different fields keep all their values, each until it is older than MeasurementTTL
+func (s *MeasurementStore) Set(model string, id string, values map[MeasurementType]float64, message map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	e := s.entry(model, id)
+	e.trackMessages(now, s.expectedIntervals[model])
+	e.received(now)
+	e.lastMessage = message
+	for f := range message {
+		e.fields[f] = true
+	}
+
+	for mt, v := range values {
+		e.values[mt] = storedValue{e.continueCounter(mt, v), now}
+	}
+}
+
+// count a repeated message of a sensor, e.g. sent multiple times in a burst, the
+// time last seen is kept, so packet counters have the time of the values
+func (s *MeasurementStore) Duplicate(model string, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.entry(model, id).duplicates++
+}
+
+// update a single value of a sensor, keeping the other values
+func (s *MeasurementStore) Update(model string, id string, mt MeasurementType, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	e := s.entry(model, id)
+	e.received(now)
+	e.fields[GetMeasurementTypeDetails(mt).MetricName] = true
+	e.values[mt] = storedValue{e.continueCounter(mt, value), now}
+}
+
+// sensors reset cumulative values (e.g. rain or energy totals) on battery change or
+// overflow, so add the values before resets to make the exported counter never go backwards
+func (e *sensorEntry) continueCounter(mt MeasurementType, v float64) float64 {
+	if GetMeasurementTypeDetails(mt).MetricValue != COUNTER {
+		return v
+	}
+
+	cs, ok := e.counters[mt]
+	if !ok {
+		cs = &counterState{last: v}
+		e.counters[mt] = cs
+	} else if v < cs.last {
+		log.Infof("STORE: counter %s of %s_%s reset from %v to %v", GetMeasurementTypeDetails(mt).MetricName, e.model, e.id, cs.last, v)
+		cs.offset += cs.last
+	}
+	cs.last = v
+
+	return cs.offset + v
+}
+
+// measurements with statistics of the sensors added by the store
+var sensorStatsTypes = map[MeasurementType]bool{PACKETS_COUNTER: true, DUPLICATES_COUNTER: true, EXPECTED_INTERVAL_SECONDS: true,
+	MISSED_COUNTER: true, RECEPTION_RATIO: true}
+
+func IsSensorStats(mt MeasurementType) bool {
+	return sensorStatsTypes[mt]
+}
+
+// get all values received within MeasurementTTL, values are not removed
+func (s *MeasurementStore) Measurements() []Measurement {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var mes []Measurement
+
+	for _, e := range s.sensors {
+		for mt, v := range e.values {
+			if now.Sub(v.received) > MeasurementTTL {
+				delete(e.values, mt)
+				continue
+			}
+
+			mes = append(mes, Measurement{mt, v.value, e.model, e.id, v.received, false})
+		}
+
+		if now.Sub(e.lastSeen) <= MeasurementTTL {
+			mes = append(mes, Measurement{PACKETS_COUNTER, e.count + e.duplicates, e.model, e.id, e.lastSeen, true})
+			mes = append(mes, Measurement{DUPLICATES_COUNTER, e.duplicates, e.model, e.id, e.lastSeen, true})
+
+			interval := e.expectedInterval(s.expectedIntervals[e.model])
+			if interval > 0 {
+				mes = append(mes, Measurement{EXPECTED_INTERVAL_SECONDS, interval.Seconds(), e.model, e.id, e.lastSeen, true})
+				mes = append(mes, Measurement{MISSED_COUNTER, e.missed, e.model, e.id, e.lastSeen, true})
+				mes = append(mes, Measurement{RECEPTION_RATIO, e.count / (e.count + e.missed), e.model, e.id, e.lastSeen, true})
+			}
+		}
+	}
+
+	return mes
+}
+
+// get all sensors ever seen, including the ones not reporting anymore
+func (s *MeasurementStore) Sensors() []SensorInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	infos := make([]SensorInfo, 0, len(s.sensors))
+	for _, e := range s.sensors {
+		fields := make([]string, 0, len(e.fields))
+		for f := range e.fields {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+
+		infos = append(infos, SensorInfo{e.model, e.id, e.firstSeen, e.lastSeen, e.count, e.duplicates, fields, e.lastMessage})
+	}
+
+	return infos
+}
@@ -0,0 +1,84 @@
+package sensors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  []float64 // times of the messages
+		interval float64
+		missed   float64
+	}{
+		{"too few gaps", []float64{0, 60, 120}, 0, 0},
+		{"regular", []float64{0, 60, 120, 181, 240}, 60, 0},
+		{"missed", []float64{0, 60, 120, 180, 360, 420}, 60, 2},
+		// single retransmission doesn't change the interval
+		{"retransmission", []float64{0, 60, 61, 120, 180, 240}, 60, 0},
+		{"retransmission first", []float64{0, 1, 60, 120, 180}, 60, 0},
+		// interval increases if the sensor sends slower, until then the longer gaps count as missed
+		{"slower", []float64{0, 30, 60, 90, 150, 210, 270, 330, 390}, 60, 2},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		e := &sensorEntry{}
+		for _, s := range test.seconds {
+			e.trackMessages(start.Add(time.Duration(s*float64(time.Second))), 0)
+		}
+
+		interval := e.expectedInterval(0).Seconds()
+		if interval != test.interval {
+			t.Errorf("%s: interval = %v, expected %v", test.name, interval, test.interval)
+		}
+		if e.missed != test.missed {
+			t.Errorf("%s: missed = %v, expected %v", test.name, e.missed, test.missed)
+		}
+	}
+}
+
+func TestTrackMessagesConfigured(t *testing.T) {
+	e := &sensorEntry{}
+	start := time.Now()
+	for _, s := range []float64{0, 1, 53, 159} {
+		e.trackMessages(start.Add(time.Duration(s*float64(time.Second))), 53*time.Second)
+	}
+
+	if e.expectedInterval(53*time.Second) != 53*time.Second {
+		t.Errorf("interval = %s, expected configured 53s", e.expectedInterval(53*time.Second))
+	}
+	if e.missed != 1 {
+		t.Errorf("missed = %v, expected 1", e.missed)
+	}
+}
+
+func TestRestoreStateInterval(t *testing.T) {
+	s := NewMeasurementStore()
+	s.RestoreState([]SensorState{{SensorModel: "Nexus-TH", SensorId: "1_42", Gaps: []float64{1, 60, 60, 61}}})
+
+	e := s.sensors["Nexus-TH_1_42"]
+	if e.expectedInterval(0) != 60*time.Second {
+		t.Errorf("restored interval = %s, expected 60s", e.expectedInterval(0))
+	}
+
+	states := s.State()
+	if len(states) != 1 || len(states[0].Gaps) != 4 {
+		t.Errorf("state gaps = %v, expected 4 gaps", states)
+	}
+}
+
+func TestMeasurementsSensorStats(t *testing.T) {
+	s := NewMeasurementStore()
+	s.Set("Nexus-TH", "1_42", map[MeasurementType]float64{TEMPERATURE_C: 21.5}, map[string]interface{}{"model": "Nexus-TH"})
+
+	for _, m := range s.Measurements() {
+		if m.SensorStats != IsSensorStats(m.Type) {
+			t.Errorf("%s: SensorStats = %v", GetMeasurementTypeDetails(m.Type).MetricName, m.SensorStats)
+		}
+		if m.Type == TEMPERATURE_C && m.SensorStats {
+			t.Errorf("temperature_c marked as sensor stats")
+		}
+	}
+}
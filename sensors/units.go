@@ -36,6 +36,14 @@ func PSI_2_HPA(v float64) float64 {
 	return v * 68.9475729318
 }
 
+func INHG_2_HPA(v float64) float64 {
+	return v * 33.8638866667
+}
+
+func MI_2_KM(v float64) float64 {
+	return v * 1.609344
+}
+
 func NO_CONV(v float64) float64 {
 	return v
 }
@@ -45,8 +53,11 @@ var convTable = map[string]*UnitConverter{
 	"_mi_h": {"mi_h", "m_s", MI_H_2_M_S},
 	"_f":    {"f", "c", F_2_C},
 	"_in":   {"in", "mm", IN_2_MM},
+	"_in_h": {"in_h", "mm_h", IN_2_MM},
 	"_kpa":  {"kpa", "hpa", KPA_2_HPA},
 	"_psi":  {"psi", "hpa", PSI_2_HPA},
+	"_inhg": {"inhg", "hpa", INHG_2_HPA},
+	"_mi":   {"mi", "km", MI_2_KM},
 }
 
 func GetMeasurementConverter(typedUnit string) (string, *UnitConverter) {
@@ -54,7 +65,7 @@ func GetMeasurementConverter(typedUnit string) (string, *UnitConverter) {
 
 	for unit, conv := range convTable {
 		if strings.HasSuffix(uTU, unit) {
-			newUnit := strings.TrimSuffix(typedUnit, conv.SrcType) + conv.DstType
+			newUnit := strings.TrimSuffix(uTU, conv.SrcType) + conv.DstType
 			return newUnit, conv
 		}
 	}
@@ -32,14 +32,13 @@ type sensorDevice struct {
 
 	manufacturer string
 	product      string
+	deviceId     string // set in config, overriding vendor and product id
 	pkg_counter  float64
 	err_connect  float64
 	err_io       float64
 	err_parse    float64
 
-	temp_k   float64
-	humidity float64
-	co2      float64
+	store *MeasurementStore
 }
 
 func (s *sensorDevice) DeviceType() string {
@@ -47,6 +46,10 @@ func (s *sensorDevice) DeviceType() string {
 }
 
 func (s *sensorDevice) DeviceId() string {
+	if s.deviceId != "" {
+		return s.deviceId
+	}
+
 	return fmt.Sprintf("0x%s:0x%s", s.vId.String(), s.pId.String())
 }
 
@@ -60,40 +63,39 @@ func (s *sensorDevice) DeviceName() string {
 
 func (s *sensorDevice) GetMeasurements() []Measurement {
 
-	mes := [7]Measurement{}
-	count := 0
+	mes := s.store.Measurements()
 
-	if s.temp_k >= 0 {
-		mes[count] = Measurement{TEMPERATURE_C, s.temp_k - 273.15, "", ""}
-		s.temp_k = -1
-		count++
-	}
-
-	if s.humidity >= 0 {
-		mes[count] = Measurement{HUMIDITY_PERCENT, s.humidity, "", ""}
-		s.humidity = -1
-		count++
-	}
+	mes = append(mes, Measurement{VALUES_COUNTER, s.pkg_counter, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_CONNECT, s.err_connect, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_IO, s.err_io, "", "", time.Time{}, false})
+	mes = append(mes, Measurement{ERRORS_PARSE, s.err_parse, "", "", time.Time{}, false})
 
-	if s.co2 >= 0 {
-		mes[count] = Measurement{CO2_PPM, s.co2, "", ""}
-		s.co2 = -1
-		count++
-	}
-
-	mes[count] = Measurement{VALUES_COUNTER, s.pkg_counter, "", ""}
-	count++
+	return mes
+}
 
-	mes[count] = Measurement{ERRORS_CONNECT, s.err_connect, "", ""}
-	count++
+func (s *sensorDevice) GetSensors() []SensorInfo {
+	return s.store.Sensors()
+}
 
-	mes[count] = Measurement{ERRORS_IO, s.err_io, "", ""}
-	count++
+func (s *sensorDevice) GetState() *DeviceState {
+	return &DeviceState{
+		Counters: map[string]float64{
+			"values_counter":         s.pkg_counter,
+			"errors_connect_counter": s.err_connect,
+			"errors_io_counter":      s.err_io,
+			"errors_parse_counter":   s.err_parse,
+		},
+		Sensors: s.store.State(),
+	}
+}
 
-	mes[count] = Measurement{ERRORS_PARSE, s.err_parse, "", ""}
-	count++
+func (s *sensorDevice) restoreState(state *DeviceState) {
+	s.pkg_counter += state.Counters["values_counter"]
+	s.err_connect += state.Counters["errors_connect_counter"]
+	s.err_io += state.Counters["errors_io_counter"]
+	s.err_parse += state.Counters["errors_parse_counter"]
 
-	return mes[:count]
+	s.store.RestoreState(state.Sensors)
 }
 
 func (s *sensorDevice) closeDevice() {
@@ -254,11 +256,11 @@ func (s *sensorDevice) monitor() {
 
 					// From http://co2meters.com/Documentation/AppNotes/AN146-RAD-0401-serial-communication.pdf
 					if op == 0x50 {
-						s.co2 = val
+						s.store.Update("", "", CO2_PPM, val)
 					} else if op == 0x42 {
-						s.temp_k = val / 16
+						s.store.Update("", "", TEMPERATURE_C, val/16-273.15)
 					} else if op == 0x41 {
-						s.humidity = val / 100
+						s.store.Update("", "", HUMIDITY_PERCENT, val/100)
 					}
 				}
 			}
@@ -273,22 +275,32 @@ func InitFlags_zytemp() {
 	// no flags yet
 }
 
-func InitSensor_zytemp(cfg *DeviceConfig) (SensorDevice, error) {
+func InitSensor_zytemp(cfg *DeviceConfig, state *DeviceState) (SensorDevice, error) {
+
+	var deviceId string
+	err := cfg.Get("device_id", &deviceId)
+	if err != nil {
+		return nil, err
+	}
 
 	// check that device exists
 	s := &sensorDevice{vId: default_vid, pId: default_pid,
-		temp_k: -1, humidity: -1, co2: -1,
-		manufacturer: "", product: "",
+		store:        NewMeasurementStore(),
+		manufacturer: "", product: "", deviceId: deviceId,
 		pkg_counter: 0,
 		err_connect: 0, err_io: 0, err_parse: 0}
 
-	err := s.openDevice()
+	err = s.openDevice()
 
 	if err != nil {
 		log.Errorf("zyTemp: Error decting zytemp sensor: %s", err)
 		return nil, err
 	}
 
+	if state != nil {
+		s.restoreState(state)
+	}
+
 	go s.monitor()
 
 	return s, nil
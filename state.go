@@ -0,0 +1,137 @@
+package main
+
+// persisting counters and sensor values across restarts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sberk42/sensor_exporter/sensors"
+	log "github.com/sirupsen/logrus"
+)
+
+type ExporterState struct {
+	Devices      map[string]*sensors.DeviceState `json:"devices"`       // by device ID as used in -devices
+	IgnoreCounts map[string]int                  `json:"ignore_counts"` // by id fields of sensor config
+	FollowedIds  map[string]string               `json:"followed_ids"`  // by id fields of sensor config
+}
+
+func sensorConfigKey(sc *SensorConfig) string {
+	return strings.Join(sc.idFields, "|")
+}
+
+// read state, the state of the devices is passed to them on init
+func LoadState(stateFile string) (*ExporterState, error) {
+	jsonData, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		log.Infof("STATE: %s does not exist yet - starting without state", stateFile)
+		return &ExporterState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state ExporterState
+	err = json.Unmarshal(jsonData, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("STATE: read state from %s", stateFile)
+
+	return &state, nil
+}
+
+// restore state of the sensor configs
+func (state *ExporterState) restoreConfigState() {
+	ignoreLock.Lock()
+	defer ignoreLock.Unlock()
+
+	for _, sc := range currentMetricsConfig().config.SensorConfigs {
+		sc.IgnoreCount += state.IgnoreCounts[sensorConfigKey(sc)]
+
+		id, ok := state.FollowedIds[sensorConfigKey(sc)]
+		if ok && sc.FollowNewId {
+			sc.followSensorId(id)
+		}
+	}
+
+}
+
+func SaveState(stateFile string, devices map[string]sensors.SensorDevice) error {
+	state := ExporterState{make(map[string]*sensors.DeviceState), make(map[string]int), make(map[string]string)}
+
+	for id, dev := range devices {
+		state.Devices[id] = dev.GetState()
+	}
+
+	ignoreLock.Lock()
+	for _, sc := range currentMetricsConfig().config.SensorConfigs {
+		if sc.IgnoreCount > 0 {
+			state.IgnoreCounts[sensorConfigKey(sc)] = sc.IgnoreCount
+		}
+	}
+	ignoreLock.Unlock()
+
+	for _, sc := range currentMetricsConfig().config.SensorConfigs {
+		if sc.FollowNewId && sc.currentSensorId() != sc.SensorId {
+			state.FollowedIds[sensorConfigKey(sc)] = sc.currentSensorId()
+		}
+	}
+
+	jsonData, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to temp file and rename, so there is always a complete state file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(jsonData)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), stateFile)
+}
+
+// save state periodically and on termination
+func StartStatePersistence(stateFile string, interval time.Duration, devices map[string]sensors.SensorDevice) {
+	go func() {
+		for range time.Tick(interval) {
+			err := SaveState(stateFile, devices)
+			if err != nil {
+				log.Errorf("STATE: error saving state: %s", err)
+			}
+		}
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		log.Infof("STATE: received %s - saving state", sig)
+
+		err := SaveState(stateFile, devices)
+		if err != nil {
+			log.Errorf("STATE: error saving state: %s", err)
+		}
+
+		os.Exit(0)
+	}()
+}